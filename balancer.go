@@ -3,6 +3,11 @@
 // See LICENSE file for details.
 package balancers
 
+import (
+	"net/http"
+	"time"
+)
+
 // Balancer holds a list of connections to hosts.
 type Balancer interface {
 	// Get returns a connection that can be used for the next request.
@@ -11,3 +16,40 @@ type Balancer interface {
 	// Connections is the list of available connections.
 	Connections() []Connection
 }
+
+// RequestBalancer is implemented by balancers that take the request into
+// account when choosing a connection, e.g. to send requests for the same
+// key to the same host. Transport uses GetForRequest instead of Get for
+// balancers that implement this interface.
+type RequestBalancer interface {
+	Balancer
+
+	// GetForRequest returns a connection that can be used for r.
+	GetForRequest(r *http.Request) (Connection, error)
+}
+
+// ExcludingBalancer is implemented by balancers that can choose another
+// connection for a request than the ones in exclude, e.g. the next one on
+// a hash ring. Transport uses GetExcluding to retry and hedge requests on
+// connections that have not been tried yet. For other balancers, it asks
+// Get or GetForRequest again, and then falls back to the first non-broken
+// connection of Connections that has not been tried.
+type ExcludingBalancer interface {
+	Balancer
+
+	// GetExcluding returns a connection for r that is not in exclude.
+	GetExcluding(r *http.Request, exclude map[Connection]bool) (Connection, error)
+}
+
+// LatencyObserver is implemented by balancers that want to learn about
+// the latency of the connections they hand out. Transport calls
+// ObserveHeaders when the response headers of a request sent to conn
+// have been received, and ObserveBody when the response body has been
+// read to EOF or closed. Both durations are measured from the time the
+// request was sent. Requests that fail are not reported.
+type LatencyObserver interface {
+	// ObserveHeaders reports the time it took to receive response headers.
+	ObserveHeaders(conn Connection, d time.Duration)
+	// ObserveBody reports the time it took to receive the complete response.
+	ObserveBody(conn Connection, d time.Duration)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// WithBodyBuffer makes Transport buffer request bodies of up to limit
+// bytes in memory, so that requests without a GetBody func can be sent
+// again, e.g. when retrying or hedging on another connection. Requests
+// with larger bodies are sent as usual, but never sent again. By default,
+// only request bodies with a GetBody func are sent again.
+func WithBodyBuffer(limit int64) TransportOption {
+	return func(t *Transport) {
+		t.bodyLimit = limit
+	}
+}
+
+// requestBody gives access to the body of a request for all attempts
+// to send it.
+type requestBody struct {
+	first   io.ReadCloser                 // body of the first attempt
+	getBody func() (io.ReadCloser, error) // nil if the body cannot be sent again
+}
+
+// body returns the body of r for sending it, possibly multiple times.
+func (t *Transport) body(r *http.Request) (*requestBody, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return &requestBody{
+			first:   r.Body,
+			getBody: func() (io.ReadCloser, error) { return r.Body, nil },
+		}, nil
+	}
+	if r.GetBody != nil {
+		return &requestBody{first: r.Body, getBody: r.GetBody}, nil
+	}
+	if t.bodyLimit <= 0 || !t.mayResend() {
+		return &requestBody{first: r.Body}, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, t.bodyLimit+1))
+	if err != nil {
+		r.Body.Close()
+		return nil, err
+	}
+	if int64(len(buf)) > t.bodyLimit {
+		// Too large: send what we have read, followed by the rest.
+		return &requestBody{
+			first: struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body},
+		}, nil
+	}
+	r.Body.Close()
+	getBody := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	first, _ := getBody()
+	return &requestBody{first: first, getBody: getBody}, nil
+}
+
+// replayable returns true if the body can be sent again.
+func (b *requestBody) replayable() bool {
+	return b.getBody != nil
+}
+
+// replay returns a new copy of the body.
+func (b *requestBody) replay() (io.ReadCloser, error) {
+	if b.getBody == nil {
+		return nil, ErrBodyNotReplayable
+	}
+	return b.getBody()
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recordBody returns a handler that records the request bodies it
+// receives and responds with status.
+func recordBody(status int, bodies *[]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*bodies = append(*bodies, string(body))
+		w.WriteHeader(status)
+	}
+}
+
+func TestTransportReplaysBody(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Body    func() io.Reader
+		Options []TransportOption
+		Retried bool
+	}{
+		{
+			Name: "GetBody",
+			Body: func() io.Reader { return strings.NewReader("hello") },
+			Options: []TransportOption{
+				WithRetryPolicy(&RetryPolicy{MaxAttempts: 2}),
+			},
+			Retried: true,
+		},
+		{
+			Name: "NoGetBody",
+			Body: func() io.Reader { return io.NopCloser(strings.NewReader("hello")) },
+			Options: []TransportOption{
+				WithRetryPolicy(&RetryPolicy{MaxAttempts: 2}),
+			},
+			Retried: false,
+		},
+		{
+			Name: "Buffered",
+			Body: func() io.Reader { return io.NopCloser(strings.NewReader("hello")) },
+			Options: []TransportOption{
+				WithRetryPolicy(&RetryPolicy{MaxAttempts: 2}),
+				WithBodyBuffer(5),
+			},
+			Retried: true,
+		},
+		{
+			Name: "TooLargeToBuffer",
+			Body: func() io.Reader { return io.NopCloser(strings.NewReader("hello")) },
+			Options: []TransportOption{
+				WithRetryPolicy(&RetryPolicy{MaxAttempts: 2}),
+				WithBodyBuffer(4),
+			},
+			Retried: false,
+		},
+	}
+	for _, test := range tests {
+		var failed, ok []string
+		server1 := newTestServer(nil, recordBody(http.StatusBadGateway, &failed))
+		server2 := newTestServer(nil, recordBody(http.StatusOK, &ok))
+
+		balancer := &testRoundRobin{conns: []Connection{newHealthyConn(t, server1.URL), newHealthyConn(t, server2.URL)}}
+		client := &http.Client{Transport: NewTransport(balancer, test.Options...)}
+		req, _ := http.NewRequest("PUT", "http://localhost/", test.Body())
+		res, err := client.Do(req)
+		server1.Close()
+		server2.Close()
+		if err != nil {
+			t.Errorf("%s: %v", test.Name, err)
+			continue
+		}
+		res.Body.Close()
+
+		if len(failed) != 1 || failed[0] != "hello" {
+			t.Errorf("%s: expected first host to receive the body; got: %q", test.Name, failed)
+		}
+		if test.Retried {
+			if res.StatusCode != http.StatusOK || len(ok) != 1 || ok[0] != "hello" {
+				t.Errorf("%s: expected second host to receive the body; got: %d, %q", test.Name, res.StatusCode, ok)
+			}
+		} else {
+			if res.StatusCode != http.StatusBadGateway || len(ok) != 0 {
+				t.Errorf("%s: expected no retry; got: %d, %q", test.Name, res.StatusCode, ok)
+			}
+		}
+	}
+}
+
+func TestTransportRefusesRetryWithoutReplayableBody(t *testing.T) {
+	var bodies []string
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up := newTestServer(nil, recordBody(http.StatusOK, &bodies))
+	defer up.Close()
+
+	balancer := &testRoundRobin{conns: []Connection{newHealthyConn(t, down.URL), newHealthyConn(t, up.URL)}}
+	client := &http.Client{Transport: NewTransport(balancer, WithRetryPolicy(&RetryPolicy{MaxAttempts: 2}))}
+
+	req, _ := http.NewRequest("POST", "http://localhost/", io.NopCloser(strings.NewReader("hello")))
+	_, err := client.Do(req)
+	if !errors.Is(err, ErrBodyNotReplayable) {
+		t.Errorf("expected %v; got: %v", ErrBodyNotReplayable, err)
+	}
+	if len(bodies) != 0 {
+		t.Errorf("expected no retry; got: %q", bodies)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenEpsilon tolerates rounding errors when fractions of tokens are
+// added up.
+const tokenEpsilon = 1e-9
+
+// RetryBudget limits the number of retries and hedged requests of a
+// Transport, so that they do not multiply the load on the hosts during
+// an outage. See WithRetryBudget.
+//
+// The budget is a token bucket: every request adds a fraction of a
+// token, e.g. 0.2, and tokens are also added at a minimum rate per
+// second, so that retries remain possible when there is little traffic.
+// Every retry and hedged request takes a whole token, and is dropped if
+// there is none left.
+type RetryBudget struct {
+	ratio    float64
+	minRate  float64
+	capacity float64
+	now      func() time.Time
+
+	mu     sync.Mutex // guards the following variables
+	tokens float64
+	last   time.Time // time of the last refill
+
+	requests atomic.Int64
+	retries  atomic.Int64
+	dropped  atomic.Int64
+}
+
+// RetryBudgetOption configures a RetryBudget.
+type RetryBudgetOption func(*RetryBudget)
+
+// WithRetryRatio sets the number of retries per request, e.g. 0.2 for
+// retries of up to 20% of recent requests. It is 0.2 by default.
+func WithRetryRatio(ratio float64) RetryBudgetOption {
+	return func(b *RetryBudget) {
+		b.ratio = ratio
+	}
+}
+
+// WithMinRetryRate sets the number of retries per second that are allowed
+// regardless of the number of requests. It is 10 by default.
+func WithMinRetryRate(perSecond float64) RetryBudgetOption {
+	return func(b *RetryBudget) {
+		b.minRate = perSecond
+	}
+}
+
+// WithRetryBurst sets the maximum number of tokens in the budget, i.e.
+// the number of retries that can be sent in a row. It is 100 by default.
+func WithRetryBurst(n int) RetryBudgetOption {
+	return func(b *RetryBudget) {
+		if n > 0 {
+			b.capacity = float64(n)
+		}
+	}
+}
+
+// NewRetryBudget creates a new retry budget. It starts with the tokens
+// of one second at the minimum rate.
+func NewRetryBudget(opts ...RetryBudgetOption) *RetryBudget {
+	b := &RetryBudget{
+		ratio:    0.2,
+		minRate:  10,
+		capacity: 100,
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.tokens = math.Min(b.minRate, b.capacity)
+	b.last = b.now()
+	return b
+}
+
+// WithRetryBudget makes Transport drop retries and hedged requests that
+// exceed the given budget. The budget may be shared by several
+// Transports. By default, retries are not limited.
+func WithRetryBudget(b *RetryBudget) TransportOption {
+	return func(t *Transport) {
+		t.budget = b
+	}
+}
+
+// RetryBudgetStats are the counters of a RetryBudget.
+type RetryBudgetStats struct {
+	// Requests is the number of requests, excluding retries.
+	Requests int64
+	// Retries is the number of retries and hedged requests that were sent.
+	Retries int64
+	// Dropped is the number of retries and hedged requests that were
+	// dropped because the budget was exhausted.
+	Dropped int64
+	// Tokens is the number of retries that may currently be sent.
+	Tokens float64
+}
+
+// Stats returns the counters of the budget, e.g. for monitoring.
+func (b *RetryBudget) Stats() RetryBudgetStats {
+	b.mu.Lock()
+	b.refill()
+	tokens := b.tokens
+	b.mu.Unlock()
+	return RetryBudgetStats{
+		Requests: b.requests.Load(),
+		Retries:  b.retries.Load(),
+		Dropped:  b.dropped.Load(),
+		Tokens:   tokens,
+	}
+}
+
+// deposit records a new request.
+func (b *RetryBudget) deposit() {
+	b.requests.Add(1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens = math.Min(b.tokens+b.ratio, b.capacity)
+}
+
+// withdraw returns true if a retry or hedged request may be sent, and
+// records it.
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	b.refill()
+	ok := b.tokens+tokenEpsilon >= 1
+	if ok {
+		b.tokens--
+	}
+	b.mu.Unlock()
+
+	if ok {
+		b.retries.Add(1)
+	} else {
+		b.dropped.Add(1)
+	}
+	return ok
+}
+
+// refund returns the token of a retry that could not be sent after all.
+func (b *RetryBudget) refund() {
+	b.retries.Add(-1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.tokens+1, b.capacity)
+}
+
+// refund returns the budget token of a retry or hedged request that
+// could not be sent after all, if the Transport has a budget.
+func (t *Transport) refund() {
+	if t.budget != nil {
+		t.budget.refund()
+	}
+}
+
+// refill adds the tokens of the minimum rate since the last refill. The
+// caller must hold b.mu.
+func (b *RetryBudget) refill() {
+	now := b.now()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.tokens+b.minRate*elapsed.Seconds(), b.capacity)
+	}
+	b.last = now
+}
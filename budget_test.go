@@ -0,0 +1,139 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Now()
+	b := NewRetryBudget(WithRetryRatio(0.2), WithMinRetryRate(0), WithRetryBurst(3))
+	b.now = func() time.Time { return now }
+
+	if b.withdraw() {
+		t.Error("expected empty budget")
+	}
+	for i := 0; i < 10; i++ {
+		b.deposit()
+	}
+	if !b.withdraw() || !b.withdraw() {
+		t.Error("expected 2 retries for 10 requests")
+	}
+	if b.withdraw() {
+		t.Error("expected budget to be exhausted")
+	}
+
+	// Tokens do not pile up beyond the burst.
+	for i := 0; i < 100; i++ {
+		b.deposit()
+	}
+	stats := b.Stats()
+	if stats.Requests != 110 || stats.Retries != 2 || stats.Dropped != 2 || stats.Tokens != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRetryBudgetMinRate(t *testing.T) {
+	now := time.Now()
+	b := NewRetryBudget(WithRetryRatio(0), WithMinRetryRate(2))
+	b.now = func() time.Time { return now }
+
+	// The budget starts with the tokens of one second.
+	if !b.withdraw() || !b.withdraw() || b.withdraw() {
+		t.Error("expected 2 retries initially")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !b.withdraw() || b.withdraw() {
+		t.Error("expected 1 retry after half a second")
+	}
+}
+
+func TestTransportRetryBudget(t *testing.T) {
+	var requests atomic.Int32
+	failed := newTestServer(&requests, respondWith(http.StatusBadGateway))
+	defer failed.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	budget := NewRetryBudget(WithRetryRatio(0), WithMinRetryRate(1))
+	balancer := &testRoundRobin{conns: []Connection{newHealthyConn(t, failed.URL), newHealthyConn(t, failed.URL+"/"), newHealthyConn(t, down.URL)}}
+	client := &http.Client{Transport: NewTransport(balancer,
+		WithRetryPolicy(&RetryPolicy{MaxAttempts: 3}),
+		WithRetryBudget(budget),
+	)}
+
+	// The single token is used for the first retry.
+	res, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if requests.Load() != 2 {
+		t.Errorf("expected 1 retry; got %d requests", requests.Load())
+	}
+
+	// Connection errors are annotated when the budget is exhausted.
+	balancer.idx = 2
+	_, err = client.Get("http://localhost/")
+	if !errors.Is(err, ErrRetryBudgetExhausted) {
+		t.Errorf("expected %v; got: %v", ErrRetryBudgetExhausted, err)
+	}
+
+	stats := budget.Stats()
+	if stats.Requests != 2 || stats.Retries != 1 || stats.Dropped != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestTransportRefundsUnsentRetries(t *testing.T) {
+	var requests atomic.Int32
+	failed := newTestServer(&requests, respondWith(http.StatusBadGateway))
+	defer failed.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	budget := NewRetryBudget(WithRetryRatio(0), WithMinRetryRate(1))
+	budget.now = func() time.Time { return time.Time{} }
+	budget.last = time.Time{}
+	balancer := &testRoundRobin{conns: []Connection{newHealthyConn(t, failed.URL), newHealthyConn(t, down.URL)}}
+	policy := &RetryPolicy{MaxAttempts: 2, Backoff: func(int) time.Duration { return time.Hour }}
+	client := &http.Client{Transport: NewTransport(balancer, WithRetryPolicy(policy), WithRetryBudget(budget))}
+
+	// The backoff is cut short by cancellation.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://localhost/", nil)
+	if res, err := client.Do(req); err == nil {
+		res.Body.Close()
+	}
+	if stats := budget.Stats(); stats.Retries != 0 || stats.Tokens != 1 {
+		t.Errorf("expected token of canceled retry to be refunded; got: %+v", stats)
+	}
+
+	// The body cannot be replayed.
+	policy.Backoff = nil
+	balancer.idx = 1
+	failure := errors.New("failure")
+	req, _ = http.NewRequest("PUT", "http://localhost/", strings.NewReader("body"))
+	req.GetBody = func() (io.ReadCloser, error) { return nil, failure }
+	_, err := client.Do(req)
+	if !errors.Is(err, failure) {
+		t.Errorf("expected %v; got: %v", failure, err)
+	}
+	if stats := budget.Stats(); stats.Retries != 0 || stats.Tokens != 1 {
+		t.Errorf("expected token of unsent retry to be refunded; got: %+v", stats)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected no retry; got %d requests", requests.Load())
+	}
+}
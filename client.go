@@ -9,8 +9,9 @@ import (
 
 // NewClient returns a http Client that applies a certain scheduling algorithm
 // (like round-robin) to load balance between several HTTP servers.
-func NewClient(b Balancer) *http.Client {
+// The options configure the underlying Transport.
+func NewClient(b Balancer, opts ...TransportOption) *http.Client {
 	return &http.Client{
-		Transport: &Transport{balancer: b},
+		Transport: NewTransport(b, opts...),
 	}
 }
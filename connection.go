@@ -4,13 +4,15 @@
 package balancers
 
 import (
-	"io/ioutil"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,20 +26,81 @@ type Connection interface {
 	IsBroken() bool
 }
 
+// Weighter is implemented by connections that carry a weight. Balancers
+// that support weights, e.g. the one in the weighted package, send
+// proportionally more requests to connections with a higher weight.
+type Weighter interface {
+	// Weight returns the weight of the connection.
+	Weight() int
+}
+
+// WeightOf returns the weight of the given connection. Connections that
+// do not implement Weighter have a weight of 1.
+func WeightOf(c Connection) int {
+	if w, ok := c.(Weighter); ok {
+		return w.Weight()
+	}
+	return 1
+}
+
+// InflightTracker is implemented by connections that keep count of the
+// requests currently in flight. Transport calls RequestStarted when it
+// sends a request to the connection and RequestFinished when the response
+// body has been read to EOF or closed, or when the request failed.
+type InflightTracker interface {
+	// RequestStarted is called when a request is sent to the connection.
+	RequestStarted()
+	// RequestFinished is called when a request to the connection is finished.
+	RequestFinished()
+	// Inflight returns the number of requests currently in flight.
+	Inflight() int
+}
+
+// InflightOf returns the number of requests in flight for the given
+// connection. Connections that do not implement InflightTracker always
+// return 0.
+func InflightOf(c Connection) int {
+	if t, ok := c.(InflightTracker); ok {
+		return t.Inflight()
+	}
+	return 0
+}
+
 // HttpConnection is a HTTP connection to a host.
 // It implements the Connection interface and can be used by balancer
 // implementations.
 type HttpConnection struct {
 	sync.Mutex
 	url                  *url.URL
-	broken               bool
+	broken               atomic.Bool  // read without lock
+	lastErr              atomic.Value // of checkResult
+	weight               atomic.Int64
+	inflight             atomic.Int64
 	heartbeatStop        chan bool
-	client               *http.Client
 	logger               *log.Logger
-	userAgent            string
 	currentRetryInterval time.Duration
 	initialRetryInterval time.Duration
 	maxRetryInterval     time.Duration
+	httpChecker          *HTTPChecker  // default checker
+	checker              HealthChecker // overrides httpChecker if not nil
+	checkTimeout         time.Duration
+	checked              bool // true after the first health check
+	rise                 int  // successes needed to become healthy
+	fall                 int  // failures needed to become broken
+	successes            int  // consecutive successful health checks
+	failures             int  // consecutive failed health checks
+	outliers             *OutlierDetector
+	outlierHost          *outlierHost
+	slowStart            time.Duration
+	slowStartMin         float64
+	slowStartCurve       func(progress float64) float64
+	recoveredAt          atomic.Int64 // in Unix nanoseconds
+	draining             atomic.Bool
+	subscribers          subscribers
+	scheduler            *HealthScheduler // runs health checks instead of heartbeat
+	degraded             atomic.Bool
+	degradedLatency      time.Duration
+	throttledUntil       atomic.Int64 // in Unix nanoseconds
 }
 
 const (
@@ -45,32 +108,70 @@ const (
 )
 
 // NewHttpConnection creates a new HTTP connection to the given URL.
-func NewHttpConnection(url *url.URL, client *http.Client, initialRetry time.Duration, maxRetry time.Duration) *HttpConnection {
+// The options configure e.g. the health check; see ConnectionOption.
+func NewHttpConnection(url *url.URL, client *http.Client, initialRetry time.Duration, maxRetry time.Duration, opts ...ConnectionOption) *HttpConnection {
 	c := &HttpConnection{
 		url:                  url,
 		heartbeatStop:        make(chan bool),
-		client:               client,
 		logger:               log.New(os.Stderr, "", log.LstdFlags),
-		userAgent:            os.Getenv("USER_AGENT"),
 		currentRetryInterval: initialRetry,
 		initialRetryInterval: initialRetry,
 		maxRetryInterval:     maxRetry,
+		httpChecker: &HTTPChecker{
+			Client:    client,
+			UserAgent: os.Getenv("USER_AGENT"),
+		},
+		rise: 1,
+		fall: 1,
+	}
+
+	c.weight.Store(1)
+	for _, opt := range opts {
+		opt(c)
 	}
 
 	c.checkBroken()
-	go c.heartbeat()
+	if c.scheduler != nil {
+		c.scheduler.add(c)
+	} else {
+		go c.heartbeat()
+	}
 	return c
 }
 
 // Close this connection.
 func (c *HttpConnection) Close() error {
+	defer c.emit(EventRemoved, nil)
+	// Stop the heartbeat before locking, as it locks to compute the
+	// next interval.
+	if c.scheduler != nil {
+		c.scheduler.remove(c)
+	} else {
+		c.heartbeatStop <- true // wait for heartbeat ticker to stop
+	}
 	c.Lock()
 	defer c.Unlock()
-	c.heartbeatStop <- true // wait for heartbeat ticker to stop
-	c.broken = false
+	c.broken.Store(false)
+	if c.outliers != nil {
+		c.outliers.remove(c.outlierHost)
+	}
 	return nil
 }
 
+// Drain stops the HTTP connection from accepting new requests, i.e. it
+// is reported as broken from now on, while requests in flight finish.
+// Call Close when the connection is no longer needed.
+func (c *HttpConnection) Drain() {
+	if c.draining.CompareAndSwap(false, true) {
+		c.emit(EventDraining, nil)
+	}
+}
+
+// IsDraining returns true if Drain has been called.
+func (c *HttpConnection) IsDraining() bool {
+	return c.draining.Load()
+}
+
 // heartbeat periodically checks if the connection is broken.
 func (c *HttpConnection) heartbeat() {
 	for {
@@ -88,7 +189,7 @@ func (c *HttpConnection) getNextInterval() time.Duration {
 	c.Lock()
 	defer c.Unlock()
 
-	if !c.broken {
+	if !c.broken.Load() {
 		c.currentRetryInterval = c.initialRetryInterval
 		return c.initialRetryInterval
 	}
@@ -104,34 +205,104 @@ func (c *HttpConnection) getNextInterval() time.Duration {
 
 // checkBroken checks if the HTTP connection is alive.
 func (c *HttpConnection) checkBroken() {
+	c.applyCheck(c.check())
+}
+
+// check runs the health check of the HTTP connection.
+func (c *HttpConnection) check() error {
+	ctx := context.Background()
+	if c.checkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.checkTimeout)
+		defer cancel()
+	}
+
+	var checker HealthChecker = c.httpChecker
+	if c.checker != nil {
+		checker = c.checker
+	}
+	start := time.Now()
+	err := checker.Check(ctx, c.url)
+	if took := time.Since(start); err == nil && c.degradedLatency > 0 && took > c.degradedLatency {
+		err = fmt.Errorf("%w: health check of %s took %v", ErrDegraded, c.url.String(), took)
+	}
+	return err
+}
+
+// applyCheck updates the state of the HTTP connection with the result
+// of a health check.
+func (c *HttpConnection) applyCheck(err error) {
+	// Emit events after the lock is released, so that subscribers may
+	// use the connection.
+	var event EventType
+	defer func() {
+		if event != 0 {
+			c.emit(event, err)
+		}
+	}()
+
 	c.Lock()
 	defer c.Unlock()
 
-	req, err := http.NewRequest("OPTIONS", c.url.String(), strings.NewReader(""))
-	if err != nil {
-		c.broken = true
-		c.logger.Printf("Failed to create request for %s: %s", c.url.String(), err.Error())
-		return
+	c.lastErr.Store(checkResult{err})
+	// Degraded hosts are alive, so ErrDegraded counts as success.
+	degraded := errors.Is(err, ErrDegraded)
+	switch {
+	case degraded:
+		c.successes++
+		c.failures = 0
+		c.logger.Printf("Health check of %s degraded: %s", c.url.String(), err.Error())
+	case err != nil:
+		c.failures++
+		c.successes = 0
+		c.logger.Printf("Health check of %s failed: %s", c.url.String(), err.Error())
+	default:
+		c.successes++
+		c.failures = 0
 	}
-	if c.userAgent != "" {
-		req.Header.Set("User-Agent", c.userAgent)
+
+	// The first health check decides the initial state. After that, the
+	// state only changes after rise successes or fall failures in a row.
+	wasBroken := c.broken.Load()
+	wasDegraded := c.degraded.Load()
+	broken := wasBroken
+	switch {
+	case !c.checked:
+		broken = err != nil && !degraded
+	case wasBroken && c.successes >= c.rise:
+		broken = false
+		c.recoveredAt.Store(time.Now().UnixNano())
+	case !wasBroken && c.failures >= c.fall:
+		broken = true
+	}
+	// Failures below the fall threshold degrade the connection.
+	degraded = !broken && (degraded || c.failures > 0)
+	c.broken.Store(broken)
+	c.degraded.Store(degraded)
+	switch {
+	case broken && (!wasBroken || !c.checked):
+		event = EventBroken
+	case !broken && degraded && (wasBroken || !wasDegraded || !c.checked):
+		event = EventDegraded
+	case !broken && !degraded && (wasBroken || wasDegraded || !c.checked):
+		event = EventHealthy
 	}
+	c.checked = true
+}
 
-	// Use a standard HTTP client with a timeout of 5 seconds.
-	res, err := c.client.Do(req)
-	if err == nil {
-		defer res.Body.Close()
-		body, _ := ioutil.ReadAll(res.Body)
-		if res.StatusCode == http.StatusOK {
-			c.broken = false
-		} else {
-			c.broken = true
-			c.logger.Printf("Request to %s failed with status %d: %s", c.url.String(), res.StatusCode, string(body))
-		}
-	} else {
-		c.broken = true
-		c.logger.Printf("Request to %s failed: %s", c.url.String(), err.Error())
+// checkResult wraps the error of a health check for atomic.Value, which
+// cannot store nil.
+type checkResult struct {
+	err error
+}
+
+// LastError returns the reason why the last health check failed or
+// reported the host as degraded, or nil if it succeeded.
+func (c *HttpConnection) LastError() error {
+	if r, ok := c.lastErr.Load().(checkResult); ok {
+		return r.err
 	}
+	return nil
 }
 
 // URL returns the URL of the HTTP connection.
@@ -139,7 +310,52 @@ func (c *HttpConnection) URL() *url.URL {
 	return c.url
 }
 
-// IsBroken returns true if the HTTP connection is currently broken.
+// IsBroken returns true if the HTTP connection is currently broken,
+// i.e. if the health check failed, if it is ejected by its outlier
+// detector, if it is throttled, or if it is draining.
 func (c *HttpConnection) IsBroken() bool {
-	return c.broken
+	return c.broken.Load() || c.IsEjected() || c.IsThrottled() || c.IsDraining()
+}
+
+// IsEjected returns true if the HTTP connection is currently ejected by
+// its outlier detector. See WithOutlierDetector.
+func (c *HttpConnection) IsEjected() bool {
+	return c.outliers != nil && c.outliers.ejected(c.outlierHost)
+}
+
+// ReportOutcome reports the outcome of a request to the outlier detector
+// of the HTTP connection, if any.
+func (c *HttpConnection) ReportOutcome(statusCode int, err error) {
+	if c.outliers == nil {
+		return
+	}
+	if reason := c.outliers.report(c.outlierHost, statusCode, err); reason != nil {
+		c.logger.Printf("Connection %s ejected: %s", c.url.String(), reason.Error())
+		c.emit(EventEjected, reason)
+	}
+}
+
+// Weight returns the weight of the HTTP connection. It is 1 by default.
+func (c *HttpConnection) Weight() int {
+	return int(c.weight.Load())
+}
+
+// SetWeight sets the weight of the HTTP connection.
+func (c *HttpConnection) SetWeight(weight int) {
+	c.weight.Store(int64(weight))
+}
+
+// RequestStarted increments the number of requests in flight.
+func (c *HttpConnection) RequestStarted() {
+	c.inflight.Add(1)
+}
+
+// RequestFinished decrements the number of requests in flight.
+func (c *HttpConnection) RequestFinished() {
+	c.inflight.Add(-1)
+}
+
+// Inflight returns the number of requests currently in flight.
+func (c *HttpConnection) Inflight() int {
+	return int(c.inflight.Load())
 }
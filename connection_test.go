@@ -4,6 +4,10 @@
 package balancers
 
 import (
+	"context"
+	"errors"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -118,3 +122,191 @@ func TestHttpConnectionExponentialBackoff(t *testing.T) {
 
 	conn.Close()
 }
+
+func TestHttpConnectionWithHealthCheckOptions(t *testing.T) {
+	var method, path, header, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.Path
+		header = r.Header.Get("X-Check")
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	url, _ := url.Parse(server.URL + "/base/")
+	conn := NewHttpConnection(url, http.DefaultClient, 30*time.Second, 5*time.Minute,
+		WithHealthCheckPath("/_health"),
+		WithHealthCheckMethod("POST"),
+		WithHealthCheckHeader("X-Check", "1"),
+		WithHealthCheckBody([]byte("ping")),
+		WithHealthCheckStatus(StatusRange{200, 299}),
+	)
+	defer conn.Close()
+	if conn.IsBroken() {
+		t.Error("expected connection to not be broken")
+	}
+	if method != "POST" {
+		t.Errorf("expected method %q; got: %q", "POST", method)
+	}
+	if path != "/_health" {
+		t.Errorf("expected path %q; got: %q", "/_health", path)
+	}
+	if header != "1" {
+		t.Errorf("expected header %q; got: %q", "1", header)
+	}
+	if body != "ping" {
+		t.Errorf("expected body %q; got: %q", "ping", body)
+	}
+	if conn.URL() != url {
+		t.Errorf("expected URL %v; got: %v", url, conn.URL())
+	}
+}
+
+func TestHttpConnectionWithUnexpectedStatusIsBroken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	url, _ := url.Parse(server.URL)
+	conn := NewHttpConnection(url, http.DefaultClient, 30*time.Second, 5*time.Minute)
+	defer conn.Close()
+	if !conn.IsBroken() {
+		t.Error("expected connection to be broken")
+	}
+}
+
+func TestHttpConnectionWithHealthCheckTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	url, _ := url.Parse(server.URL)
+	start := time.Now()
+	conn := NewHttpConnection(url, http.DefaultClient, 30*time.Second, 5*time.Minute,
+		WithHealthCheckTimeout(50*time.Millisecond),
+	)
+	defer conn.Close()
+	if !conn.IsBroken() {
+		t.Error("expected connection to be broken")
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Errorf("expected health check to time out after about 50ms; took: %v", d)
+	}
+}
+
+func TestHttpConnectionRiseAndFallThresholds(t *testing.T) {
+	// The server answers with the given sequence of status codes.
+	statuses := []int{
+		http.StatusOK,                  // initial check: healthy
+		http.StatusInternalServerError, // 1st failure
+		http.StatusOK,                  // resets failures
+		http.StatusInternalServerError, // 1st failure
+		http.StatusInternalServerError, // 2nd failure: broken
+		http.StatusOK,                  // 1st success
+		http.StatusInternalServerError, // resets successes
+		http.StatusOK,                  // 1st success
+		http.StatusOK,                  // 2nd success
+		http.StatusOK,                  // 3rd success: healthy
+	}
+	expectBroken := []bool{false, false, false, false, true, true, true, true, true, false}
+
+	var n int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[n])
+		n++
+	}))
+	defer server.Close()
+
+	url, _ := url.Parse(server.URL)
+	conn := NewHttpConnection(url, http.DefaultClient, 30*time.Second, 5*time.Minute,
+		WithFallThreshold(2),
+		WithRiseThreshold(3),
+	)
+	defer conn.Close()
+	for i := range statuses {
+		if i > 0 {
+			conn.checkBroken()
+		}
+		if got := conn.IsBroken(); got != expectBroken[i] {
+			t.Errorf("check %d: expected broken = %v; got: %v", i, expectBroken[i], got)
+		}
+	}
+}
+
+func TestHttpConnectionInitialCheckIgnoresThresholds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	url, _ := url.Parse(server.URL)
+	conn := NewHttpConnection(url, http.DefaultClient, 30*time.Second, 5*time.Minute,
+		WithFallThreshold(3),
+	)
+	defer conn.Close()
+	if !conn.IsBroken() {
+		t.Error("expected connection to be broken after the initial check")
+	}
+}
+
+func TestHttpConnectionSlowStart(t *testing.T) {
+	healthy := true
+	checker := HealthCheckerFunc(func(context.Context, *url.URL) error {
+		if !healthy {
+			return errors.New("down")
+		}
+		return nil
+	})
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	conn := NewHttpConnection(u, http.DefaultClient, 30*time.Second, 5*time.Minute,
+		WithHealthChecker(checker),
+		WithSlowStart(time.Minute, 0.1),
+	)
+	defer conn.Close()
+	if f := conn.SlowStartFactor(); f != 1 {
+		t.Errorf("expected no slow start for the initial check; got factor %v", f)
+	}
+
+	healthy = false
+	conn.checkBroken()
+	healthy = true
+	conn.checkBroken()
+	if f := conn.SlowStartFactor(); f < 0.1 || f > 0.2 {
+		t.Errorf("expected factor to start at 0.1; got: %v", f)
+	}
+
+	conn.recoveredAt.Store(time.Now().Add(-30 * time.Second).UnixNano())
+	if f := conn.SlowStartFactor(); f < 0.54 || f > 0.56 {
+		t.Errorf("expected factor of 0.55 after half the window; got: %v", f)
+	}
+	conn.slowStartCurve = SlowStartAggression(2)
+	if f := conn.SlowStartFactor(); f < 0.73 || f > 0.74 {
+		t.Errorf("expected factor of 0.1+0.9*sqrt(0.5) with aggression 2; got: %v", f)
+	}
+
+	conn.recoveredAt.Store(time.Now().Add(-time.Minute).UnixNano())
+	if f := conn.SlowStartFactor(); f != 1 {
+		t.Errorf("expected slow start to be over; got factor %v", f)
+	}
+}
+
+func TestHttpConnectionSlowStartValidatesOptions(t *testing.T) {
+	for _, minFactor := range []float64{0, -1, 2, math.NaN()} {
+		c := new(HttpConnection)
+		WithSlowStart(time.Minute, minFactor)(c)
+		if c.slowStartMin != defaultSlowStartFactor {
+			t.Errorf("expected min factor %v to be replaced by %v; got: %v", minFactor, defaultSlowStartFactor, c.slowStartMin)
+		}
+	}
+
+	for _, aggression := range []float64{0, -2, math.NaN(), math.Inf(1)} {
+		curve := SlowStartAggression(aggression)
+		if got := curve(0.5); got != 0.5 {
+			t.Errorf("expected aggression %v to ramp up linearly; got: %v", aggression, got)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+// Package consistenthash implements a consistent-hash balancer based on
+// a ketama ring. Requests with the same key, e.g. the same URL path or
+// tenant header, are sent to the same connection. When a connection is
+// broken, added, or removed, only the keys that belong to it are moved.
+//
+// With WithBoundedLoad, the balancer implements "consistent hashing with
+// bounded loads" (Mirrokni et al.): a connection that already has too
+// many requests in flight is skipped in favor of the next one on the ring,
+// so a single hot key cannot overload a host.
+package consistenthash
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/tianlin/balancers"
+)
+
+// BalancerOptions 包含负载均衡器的配置选项
+type BalancerOptions struct {
+	key      balancers.KeyFunc
+	replicas int
+	epsilon  float64
+}
+
+// Option 定义配置选项的函数类型
+type Option func(*BalancerOptions)
+
+// WithKey sets the function that extracts the key from a request.
+// The default is balancers.PathKey.
+func WithKey(key balancers.KeyFunc) Option {
+	return func(o *BalancerOptions) {
+		o.key = key
+	}
+}
+
+// WithReplicas sets the number of virtual nodes per connection on the
+// ring. Connections implementing balancers.Weighter get replicas times
+// their weight virtual nodes. The default is 160.
+func WithReplicas(replicas int) Option {
+	return func(o *BalancerOptions) {
+		o.replicas = replicas
+	}
+}
+
+// WithBoundedLoad enables bounded loads. A connection is skipped when its
+// number of requests in flight reaches (1+epsilon) times the average
+// number of requests in flight. Lower values of epsilon spread the load
+// more evenly at the expense of moving more keys away from their
+// connection. The number of requests in flight is taken from
+// balancers.InflightTracker.
+func WithBoundedLoad(epsilon float64) Option {
+	return func(o *BalancerOptions) {
+		o.epsilon = epsilon
+	}
+}
+
+// 默认选项
+var defaultOptions = BalancerOptions{
+	key:      balancers.PathKey,
+	replicas: 160,
+}
+
+// point is a virtual node on the ring.
+type point struct {
+	hash uint32
+	conn int // index into conns
+}
+
+// Balancer implements a consistent-hash balancer.
+type Balancer struct {
+	mu       sync.RWMutex // guards the following variables
+	conns    []balancers.Connection
+	ring     []point // sorted by hash
+	key      balancers.KeyFunc
+	replicas int
+	epsilon  float64 // 0 disables bounded loads
+}
+
+// NewBalancer creates a new consistent-hash balancer. It can be
+// initialized by a variable number of connections. To change the
+// defaults, use NewBalancerWithOptions.
+func NewBalancer(conns ...balancers.Connection) (balancers.Balancer, error) {
+	b, err := NewBalancerWithOptions(conns)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewBalancerWithOptions creates a new consistent-hash balancer for the
+// given connections, configured by opts.
+func NewBalancerWithOptions(conns []balancers.Connection, opts ...Option) (*Balancer, error) {
+	options := defaultOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.key == nil {
+		return nil, errors.New("key func must not be nil")
+	}
+	if options.replicas <= 0 {
+		return nil, errors.New("replicas must be greater than 0")
+	}
+	if options.epsilon < 0 {
+		return nil, errors.New("epsilon must not be negative")
+	}
+
+	b := &Balancer{
+		conns:    make([]balancers.Connection, len(conns)),
+		key:      options.key,
+		replicas: options.replicas,
+		epsilon:  options.epsilon,
+	}
+	copy(b.conns, conns)
+	b.build()
+	return b, nil
+}
+
+// Add adds connections to the ring.
+func (b *Balancer) Add(conns ...balancers.Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conns = append(b.conns, conns...)
+	b.build()
+}
+
+// Remove removes connections from the ring.
+func (b *Balancer) Remove(conns ...balancers.Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := make([]balancers.Connection, 0, len(b.conns))
+	for _, c := range b.conns {
+		removed := false
+		for _, r := range conns {
+			if c == r {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, c)
+		}
+	}
+	b.conns = kept
+	b.build()
+}
+
+// build recreates the ring from conns. b must be locked.
+//
+// Like ketama, every md5 digest of "<url>-<n>" yields four points on the
+// ring, so the position of a connection only depends on its URL and not
+// on the other connections.
+func (b *Balancer) build() {
+	ring := make([]point, 0, len(b.conns)*b.replicas)
+	for i, c := range b.conns {
+		id := c.URL().String()
+		n := b.replicas * balancers.WeightOf(c)
+		for j := 0; j*4 < n; j++ {
+			digest := md5.Sum([]byte(id + "-" + strconv.Itoa(j)))
+			for k := 0; k < 4 && j*4+k < n; k++ {
+				ring = append(ring, point{
+					hash: binary.LittleEndian.Uint32(digest[k*4:]),
+					conn: i,
+				})
+			}
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash == ring[j].hash {
+			return ring[i].conn < ring[j].conn
+		}
+		return ring[i].hash < ring[j].hash
+	})
+	b.ring = ring
+}
+
+// hash returns the position of key on the ring.
+func hash(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(digest[:4])
+}
+
+// Get returns the connection for an empty key.
+// ErrNoConn is returned when no connection is available.
+func (b *Balancer) Get() (balancers.Connection, error) {
+	return b.lookup("", nil)
+}
+
+// GetForRequest returns the connection for the key of r. If that
+// connection is broken, the next one on the ring is used.
+// ErrNoConn is returned when no connection is available.
+func (b *Balancer) GetForRequest(r *http.Request) (balancers.Connection, error) {
+	return b.lookup(b.key(r), nil)
+}
+
+// GetExcluding returns the connection for the key of r like
+// GetForRequest, but skips the connections in exclude, i.e. it returns
+// the next one on the ring. It implements balancers.ExcludingBalancer.
+func (b *Balancer) GetExcluding(r *http.Request, exclude map[balancers.Connection]bool) (balancers.Connection, error) {
+	return b.lookup(b.key(r), exclude)
+}
+
+func (b *Balancer) lookup(key string, exclude map[balancers.Connection]bool) (balancers.Connection, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.ring) == 0 {
+		return nil, balancers.ErrNoConn
+	}
+
+	capacity := b.capacity()
+
+	h := hash(key)
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	var fallback, degraded balancers.Connection
+	for i := 0; i < len(b.ring); i++ {
+		p := b.ring[(start+i)%len(b.ring)]
+		conn := b.conns[p.conn]
+		if exclude[conn] {
+			continue
+		}
+		switch balancers.HealthOf(conn) {
+		case balancers.Unhealthy:
+			continue
+		case balancers.Degraded:
+			if degraded == nil {
+				degraded = conn
+			}
+			continue
+		}
+		if capacity < 0 || balancers.InflightOf(conn) < capacity {
+			return conn, nil
+		}
+		if fallback == nil {
+			fallback = conn
+		}
+	}
+	if fallback != nil {
+		// All connections are at capacity, which can only happen when
+		// their load changes while we walk the ring.
+		return fallback, nil
+	}
+	if degraded != nil {
+		// No healthy connection is left.
+		return degraded, nil
+	}
+	return nil, balancers.ErrNoConn
+}
+
+// capacity returns the maximum number of requests in flight that a
+// connection may have to be picked, or -1 if loads are not bounded.
+// b must be locked.
+func (b *Balancer) capacity() int {
+	if b.epsilon <= 0 {
+		return -1
+	}
+	total, n := 0, 0
+	for _, c := range b.conns {
+		if !c.IsBroken() {
+			total += balancers.InflightOf(c)
+			n++
+		}
+	}
+	if n == 0 {
+		return -1
+	}
+	// Include the request we are about to place.
+	avg := float64(total+1) / float64(n)
+	return int(math.Ceil(avg * (1 + b.epsilon)))
+}
+
+// Connections returns a list of all connections.
+func (b *Balancer) Connections() []balancers.Connection {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	conns := make([]balancers.Connection, len(b.conns))
+	copy(conns, b.conns)
+	return conns
+}
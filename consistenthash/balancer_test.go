@@ -0,0 +1,298 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package consistenthash
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/internal/balancertest"
+)
+
+func newRequest(path string) *http.Request {
+	r, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+	return r
+}
+
+// assign returns the connection for 1000 different paths.
+func assign(t *testing.T, b *Balancer) map[string]balancers.Connection {
+	m := make(map[string]balancers.Connection)
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("/path/%d", i)
+		conn, err := b.GetForRequest(newRequest(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[path] = conn
+	}
+	return m
+}
+
+func TestBalancerErrNoConnWithoutConnections(t *testing.T) {
+	balancer, err := NewBalancerWithOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = balancer.GetForRequest(newRequest("/"))
+	if err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerIsConsistent(t *testing.T) {
+	conns := []balancers.Connection{
+		balancertest.NewConn("http://a"),
+		balancertest.NewConn("http://b"),
+		balancertest.NewConn("http://c"),
+	}
+	b1, _ := NewBalancerWithOptions(conns)
+	b2, _ := NewBalancerWithOptions([]balancers.Connection{conns[2], conns[0], conns[1]})
+
+	m1 := assign(t, b1)
+	m2 := assign(t, b2)
+	counts := make(map[balancers.Connection]int)
+	for path, conn := range m1 {
+		if m2[path] != conn {
+			t.Fatalf("expected %q to map to %q; got: %q", path, conn.URL(), m2[path].URL())
+		}
+		counts[conn]++
+	}
+	for _, c := range conns {
+		if counts[c] < 200 {
+			t.Errorf("expected %q to receive a fair share of keys; got: %d", c.URL(), counts[c])
+		}
+	}
+}
+
+func TestBalancerRemapsOnlyKeysOfBrokenConnection(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	c := balancertest.NewConn("http://c")
+	balancer, _ := NewBalancerWithOptions([]balancers.Connection{a, b, c})
+
+	before := assign(t, balancer)
+	b.Broken = true
+	after := assign(t, balancer)
+
+	for path, conn := range before {
+		if conn != b && after[path] != conn {
+			t.Errorf("expected %q to stay on %q; got: %q", path, conn.URL(), after[path].URL())
+		}
+		if after[path] == b {
+			t.Errorf("expected %q to move away from broken connection", path)
+		}
+	}
+
+	b.Broken = false
+	recovered := assign(t, balancer)
+	for path, conn := range before {
+		if recovered[path] != conn {
+			t.Errorf("expected %q to move back to %q; got: %q", path, conn.URL(), recovered[path].URL())
+		}
+	}
+}
+
+func TestBalancerAddAndRemove(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	c := balancertest.NewConn("http://c")
+	d := balancertest.NewConn("http://d")
+	balancer, _ := NewBalancerWithOptions([]balancers.Connection{a, b, c})
+
+	before := assign(t, balancer)
+	balancer.Add(d)
+	after := assign(t, balancer)
+
+	moved := 0
+	for path, conn := range before {
+		if after[path] != conn {
+			if after[path] != d {
+				t.Errorf("expected %q to stay on %q or move to %q; got: %q", path, conn.URL(), d.URL(), after[path].URL())
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 400 {
+		t.Errorf("expected about a quarter of the keys to move; got: %d", moved)
+	}
+
+	balancer.Remove(d)
+	removed := assign(t, balancer)
+	for path, conn := range before {
+		if removed[path] != conn {
+			t.Errorf("expected %q to move back to %q; got: %q", path, conn.URL(), removed[path].URL())
+		}
+	}
+	if n := len(balancer.Connections()); n != 3 {
+		t.Errorf("expected %d connections; got: %d", 3, n)
+	}
+}
+
+func TestBalancerWithBoundedLoadSkipsOverloadedConnection(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	c := balancertest.NewConn("http://c")
+	balancer, err := NewBalancerWithOptions([]balancers.Connection{a, b, c}, WithBoundedLoad(0.25))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Send a hot key many times without finishing the requests.
+	hot, err := balancer.GetForRequest(newRequest("/hot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		conn, err := balancer.GetForRequest(newRequest("/hot"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.(*balancertest.Conn).RequestStarted()
+	}
+
+	// No connection may exceed ceil((30/3)*(1.25)) = 13 requests in flight.
+	for _, c := range []*balancertest.Conn{a, b, c} {
+		if c.Pending > 13 {
+			t.Errorf("expected %q to have at most %d requests in flight; got: %d", c.URL(), 13, c.Pending)
+		}
+	}
+	if hot.(*balancertest.Conn).Pending == 0 {
+		t.Errorf("expected hot key to be sent to %q first", hot.URL())
+	}
+
+	// Once the load is gone, the key goes back to its connection.
+	a.Pending, b.Pending, c.Pending = 0, 0, 0
+	conn, err := balancer.GetForRequest(newRequest("/hot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != hot {
+		t.Errorf("expected %q; got: %q", hot.URL(), conn.URL())
+	}
+}
+
+func TestBalancerWithoutBoundedLoadIgnoresLoad(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	balancer, _ := NewBalancerWithOptions([]balancers.Connection{a, b})
+
+	hot, _ := balancer.GetForRequest(newRequest("/hot"))
+	hot.(*balancertest.Conn).Pending = 100
+	conn, _ := balancer.GetForRequest(newRequest("/hot"))
+	if conn != hot {
+		t.Errorf("expected %q; got: %q", hot.URL(), conn.URL())
+	}
+}
+
+func TestBalancerWithHeaderKey(t *testing.T) {
+	var visited []string
+
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "OPTIONS" {
+				visited = append(visited, name)
+			}
+		}
+	}
+	server1 := httptest.NewServer(handler("server1"))
+	defer server1.Close()
+	server2 := httptest.NewServer(handler("server2"))
+	defer server2.Close()
+
+	url1, _ := url.Parse(server1.URL)
+	url2, _ := url.Parse(server2.URL)
+	conn1 := balancers.NewHttpConnection(url1, http.DefaultClient, 30*time.Second, 5*time.Minute)
+	conn2 := balancers.NewHttpConnection(url2, http.DefaultClient, 30*time.Second, 5*time.Minute)
+	defer conn1.Close()
+	defer conn2.Close()
+	balancer, err := NewBalancerWithOptions(
+		[]balancers.Connection{conn1, conn2},
+		WithKey(balancers.HeaderKey("X-Tenant")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := balancers.NewClient(balancer)
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/path/%d", i), nil)
+		req.Header.Set("X-Tenant", "tenant-1")
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(visited) != 5 {
+		t.Fatalf("expected %d URLs to be visited; got: %d", 5, len(visited))
+	}
+	for i := range visited {
+		if visited[i] != visited[0] {
+			t.Errorf("expected all requests of a tenant to go to %s; got: %v", visited[0], visited)
+			break
+		}
+	}
+}
+
+func TestBalancerGetExcluding(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	c := balancertest.NewConn("http://c")
+	balancer, err := NewBalancerWithOptions([]balancers.Connection{a, b, c})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Excluding a connection picks the next one on the ring, i.e. the one
+	// that would be picked if it were broken.
+	before := assign(t, balancer)
+	b.Broken = true
+	after := assign(t, balancer)
+	b.Broken = false
+	for path, conn := range before {
+		if conn != b {
+			continue
+		}
+		next, err := balancer.GetExcluding(newRequest(path), map[balancers.Connection]bool{b: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != after[path] {
+			t.Errorf("expected %q to move to %q; got: %q", path, after[path].URL(), next.URL())
+		}
+	}
+
+	exclude := map[balancers.Connection]bool{a: true, b: true, c: true}
+	if _, err := balancer.GetExcluding(newRequest("/"), exclude); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestTransportRetriesOnNextConnection(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	balancer, err := NewBalancerWithOptions([]balancers.Connection{balancertest.NewConn(up.URL), balancertest.NewConn(down.URL)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: balancers.NewTransport(balancer,
+		balancers.WithRetryPolicy(&balancers.RetryPolicy{MaxAttempts: 3}),
+	)}
+
+	// Keys that hash to the dead host are retried on the other one.
+	for i := 0; i < 50; i++ {
+		res, err := client.Get(fmt.Sprintf("http://localhost/key/%d", i))
+		if err != nil {
+			t.Fatalf("key %d: %v", i, err)
+		}
+		res.Body.Close()
+	}
+}
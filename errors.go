@@ -9,3 +9,18 @@ import (
 
 // ErrNoConn must be returned when a Balancer does not find a (non-broken) connection.
 var ErrNoConn = errors.New("no connection")
+
+// ErrDegraded is returned, possibly wrapped, by health checkers when the
+// host is alive but degraded, e.g. slow or only partially functional.
+// See Health.
+var ErrDegraded = errors.New("degraded")
+
+// ErrBodyNotReplayable is returned, wrapped, by Transport when a failed
+// request would have been retried, but its body cannot be sent again.
+// See WithBodyBuffer.
+var ErrBodyNotReplayable = errors.New("request body cannot be replayed")
+
+// ErrRetryBudgetExhausted is returned, wrapped, by Transport when a failed
+// request would have been retried, but the retry budget is exhausted.
+// See WithRetryBudget.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
@@ -0,0 +1,152 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// EventType is the type of a state change of a connection.
+type EventType int
+
+const (
+	// EventHealthy is emitted when a connection becomes healthy.
+	EventHealthy EventType = iota + 1
+	// EventBroken is emitted when a connection becomes broken.
+	EventBroken
+	// EventDegraded is emitted when a connection becomes degraded,
+	// see Health.
+	EventDegraded
+	// EventEjected is emitted when a connection is ejected by its
+	// outlier detector.
+	EventEjected
+	// EventDraining is emitted when a connection stops accepting new
+	// requests, see HttpConnection.Drain.
+	EventDraining
+	// EventRemoved is emitted when a connection is closed.
+	EventRemoved
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventHealthy:
+		return "healthy"
+	case EventBroken:
+		return "broken"
+	case EventDegraded:
+		return "degraded"
+	case EventEjected:
+		return "ejected"
+	case EventDraining:
+		return "draining"
+	case EventRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a state change of a connection.
+type Event struct {
+	// Type of the state change.
+	Type EventType
+	// Time of the state change.
+	Time time.Time
+	// URL of the connection.
+	URL *url.URL
+	// Err is the reason for EventBroken, EventDegraded, and EventEjected,
+	// e.g. the error of the failed health check. It is nil for all other
+	// events.
+	Err error
+}
+
+// Notifier is implemented by connections that emit events on state
+// changes.
+type Notifier interface {
+	// Subscribe registers fn to be called on every event of the
+	// connection. It returns a function that cancels the subscription.
+	Subscribe(fn func(Event)) (unsubscribe func())
+}
+
+// SubscribeBalancer registers fn to be called on every event of all
+// connections of b that implement Notifier. Connections added to b
+// later are not included. It returns a function that cancels all
+// subscriptions.
+func SubscribeBalancer(b Balancer, fn func(Event)) (unsubscribe func()) {
+	var cancels []func()
+	for _, conn := range b.Connections() {
+		if n, ok := conn.(Notifier); ok {
+			cancels = append(cancels, n.Subscribe(fn))
+		}
+	}
+	return func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
+
+// subscribers is a list of event handlers.
+type subscribers struct {
+	mu   sync.Mutex // guards the following variables
+	fns  map[int]func(Event)
+	next int
+}
+
+// add registers fn and returns a function that removes it again.
+func (s *subscribers) add(fn func(Event)) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fns == nil {
+		s.fns = make(map[int]func(Event))
+	}
+	id := s.next
+	s.next++
+	s.fns[id] = fn
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.fns, id)
+	}
+}
+
+// emit calls all handlers with the given event.
+func (s *subscribers) emit(e Event) {
+	s.mu.Lock()
+	fns := make([]func(Event), 0, len(s.fns))
+	for _, fn := range s.fns {
+		fns = append(fns, fn)
+	}
+	s.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(e)
+	}
+}
+
+// WithSubscriber registers fn to be called on every event of the
+// connection, including the result of the initial health check.
+// See HttpConnection.Subscribe.
+func WithSubscriber(fn func(Event)) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.subscribers.add(fn)
+	}
+}
+
+// Subscribe registers fn to be called on every event of the HTTP
+// connection. Handlers are called synchronously from the goroutine that
+// changed the state, e.g. the heartbeat or Transport.RoundTrip, so they
+// should return quickly. It returns a function that cancels the
+// subscription.
+func (c *HttpConnection) Subscribe(fn func(Event)) (unsubscribe func()) {
+	return c.subscribers.add(fn)
+}
+
+// emit sends an event of the given type to all subscribers.
+func (c *HttpConnection) emit(t EventType, err error) {
+	c.subscribers.emit(Event{Type: t, Time: time.Now(), URL: c.url, Err: err})
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHttpConnectionEvents(t *testing.T) {
+	healthy := false
+	checker := HealthCheckerFunc(func(context.Context, *url.URL) error {
+		if !healthy {
+			return errors.New("down")
+		}
+		return nil
+	})
+
+	var events []Event
+	d := NewOutlierDetector(WithConsecutiveFailures(1))
+	newHealthyConn(t, "http://127.0.0.1:9201", WithOutlierDetector(d))
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	conn := NewHttpConnection(u, http.DefaultClient, 30*time.Second, 5*time.Minute,
+		WithHealthChecker(checker),
+		WithOutlierDetector(d),
+		WithSubscriber(func(e Event) { events = append(events, e) }),
+	)
+	conn.checkBroken() // still broken: no event
+	healthy = true
+	conn.checkBroken()
+	conn.checkBroken() // still healthy: no event
+	healthy = false
+	conn.checkBroken()
+	healthy = true
+	conn.checkBroken()
+	conn.ReportOutcome(http.StatusServiceUnavailable, nil) // ejects
+	conn.Drain()
+	conn.Drain() // already draining: no event
+	conn.Close()
+
+	expected := []EventType{EventBroken, EventHealthy, EventBroken, EventHealthy, EventEjected, EventDraining, EventRemoved}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events; got: %v", len(expected), events)
+	}
+	for i, e := range events {
+		if e.Type != expected[i] {
+			t.Errorf("expected event %d to be %v; got: %v", i, expected[i], e.Type)
+		}
+		if e.URL != u {
+			t.Errorf("expected event %d to have URL %v; got: %v", i, u, e.URL)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("expected event %d to have a timestamp", i)
+		}
+		hasErr := e.Type == EventBroken || e.Type == EventEjected
+		if hasErr != (e.Err != nil) {
+			t.Errorf("expected event %d of type %v to have a reason: %v; got: %v", i, e.Type, hasErr, e.Err)
+		}
+	}
+	if !conn.IsBroken() {
+		t.Error("expected draining connection to be broken")
+	}
+}
+
+func TestSubscribeBalancer(t *testing.T) {
+	healthy := true
+	checker := HealthCheckerFunc(func(context.Context, *url.URL) error {
+		if !healthy {
+			return errors.New("down")
+		}
+		return nil
+	})
+	u1, _ := url.Parse("http://127.0.0.1:9200")
+	u2, _ := url.Parse("http://127.0.0.1:9201")
+	conn1 := NewHttpConnection(u1, http.DefaultClient, 30*time.Second, 5*time.Minute, WithHealthChecker(checker))
+	conn2 := NewHttpConnection(u2, http.DefaultClient, 30*time.Second, 5*time.Minute, WithHealthChecker(checker))
+	defer conn1.Close()
+	defer conn2.Close()
+	b := &testRoundRobin{conns: []Connection{conn1, conn2, &testConn{url: u1}}}
+
+	var events []Event
+	unsubscribe := SubscribeBalancer(b, func(e Event) { events = append(events, e) })
+	healthy = false
+	conn1.checkBroken()
+	conn2.checkBroken()
+	if len(events) != 2 || events[0].URL != u1 || events[1].URL != u2 {
+		t.Fatalf("expected broken events of both connections; got: %v", events)
+	}
+	if events[0].Err == nil || events[0].Err.Error() != "down" {
+		t.Errorf("expected reason to be the failed health check; got: %v", events[0].Err)
+	}
+
+	unsubscribe()
+	healthy = true
+	conn1.checkBroken()
+	if len(events) != 2 {
+		t.Errorf("expected no events after unsubscribe; got: %v", events)
+	}
+}
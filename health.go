@@ -0,0 +1,67 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+// Health is the state of a connection.
+type Health int
+
+const (
+	// Healthy connections are used as usual.
+	Healthy Health = iota
+	// Degraded connections are alive, but e.g. slow, partially failing,
+	// or report themselves as degraded. Balancers only use them when no
+	// healthy connection is left.
+	Degraded
+	// Unhealthy connections are broken and never used.
+	Unhealthy
+)
+
+// String returns the name of the health state.
+func (h Health) String() string {
+	switch h {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case Unhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// HealthReporter is implemented by connections that distinguish between
+// healthy and degraded, in addition to broken.
+type HealthReporter interface {
+	// Health returns the current health of the connection.
+	Health() Health
+}
+
+// HealthOf returns the health of the given connection. Broken connections
+// are Unhealthy. Connections that do not implement HealthReporter are
+// Healthy unless they are broken.
+func HealthOf(c Connection) Health {
+	if c.IsBroken() {
+		return Unhealthy
+	}
+	if r, ok := c.(HealthReporter); ok {
+		return r.Health()
+	}
+	return Healthy
+}
+
+// Health returns the health of the HTTP connection. It is Degraded if
+// the last health check returned ErrDegraded, took longer than the
+// latency set with WithDegradedLatency, or if health checks failed but
+// not yet often enough to mark the connection as broken.
+func (c *HttpConnection) Health() Health {
+	switch {
+	case c.IsBroken():
+		return Unhealthy
+	case c.degraded.Load():
+		return Degraded
+	default:
+		return Healthy
+	}
+}
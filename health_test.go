@@ -0,0 +1,130 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHTTPCheckerDegraded(t *testing.T) {
+	status, health := http.StatusOK, "yellow"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"status":"` + health + `"}`))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	checker := &HTTPChecker{
+		Method:             "GET",
+		Status:             []StatusRange{{200, 299}},
+		DegradedStatus:     []StatusRange{{429, 429}},
+		JSONPath:           "status",
+		JSONValues:         []interface{}{"green"},
+		DegradedJSONValues: []interface{}{"yellow"},
+	}
+	tests := []struct {
+		Status   int
+		Health   string
+		Expected Health
+	}{
+		{200, "green", Healthy},
+		{200, "yellow", Degraded},
+		{200, "red", Unhealthy},
+		{429, "green", Degraded},
+		{503, "green", Unhealthy},
+	}
+	for i, test := range tests {
+		status, health = test.Status, test.Health
+		err := checker.Check(context.Background(), u)
+		var got Health
+		switch {
+		case errors.Is(err, ErrDegraded):
+			got = Degraded
+		case err != nil:
+			got = Unhealthy
+		}
+		if got != test.Expected {
+			t.Errorf("#%d: expected %v; got: %v (%v)", i, test.Expected, got, err)
+		}
+	}
+}
+
+func TestHttpConnectionHealth(t *testing.T) {
+	var result error
+	checker := HealthCheckerFunc(func(context.Context, *url.URL) error { return result })
+
+	var events []EventType
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	conn := NewHttpConnection(u, http.DefaultClient, 30*time.Second, 5*time.Minute,
+		WithHealthChecker(checker),
+		WithFallThreshold(2),
+		WithSubscriber(func(e Event) { events = append(events, e.Type) }),
+	)
+	defer conn.Close()
+	if h := conn.Health(); h != Healthy {
+		t.Fatalf("expected %v; got: %v", Healthy, h)
+	}
+
+	// Backend reports itself as degraded.
+	result = fmt.Errorf("%w: replica lag", ErrDegraded)
+	conn.checkBroken()
+	if h := HealthOf(conn); h != Degraded {
+		t.Errorf("expected %v; got: %v", Degraded, h)
+	}
+	if conn.IsBroken() {
+		t.Error("expected degraded connection to not be broken")
+	}
+
+	// A failure below the fall threshold degrades the connection...
+	result = nil
+	conn.checkBroken()
+	result = errors.New("down")
+	conn.checkBroken()
+	if h := conn.Health(); h != Degraded {
+		t.Errorf("expected %v after one failure; got: %v", Degraded, h)
+	}
+	// ...and reaching it breaks the connection.
+	conn.checkBroken()
+	if h := conn.Health(); h != Unhealthy {
+		t.Errorf("expected %v after two failures; got: %v", Unhealthy, h)
+	}
+
+	expected := []EventType{EventHealthy, EventDegraded, EventHealthy, EventDegraded, EventBroken}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Errorf("expected events %v; got: %v", expected, events)
+	}
+}
+
+func TestHttpConnectionWithDegradedLatency(t *testing.T) {
+	delay := time.Duration(0)
+	checker := HealthCheckerFunc(func(context.Context, *url.URL) error {
+		time.Sleep(delay)
+		return nil
+	})
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	conn := NewHttpConnection(u, http.DefaultClient, 30*time.Second, 5*time.Minute,
+		WithHealthChecker(checker),
+		WithDegradedLatency(20*time.Millisecond),
+	)
+	defer conn.Close()
+	if h := conn.Health(); h != Healthy {
+		t.Errorf("expected %v; got: %v", Healthy, h)
+	}
+	delay = 30 * time.Millisecond
+	conn.checkBroken()
+	if h := conn.Health(); h != Degraded {
+		t.Errorf("expected slow connection to be %v; got: %v", Degraded, h)
+	}
+	if err := conn.LastError(); !errors.Is(err, ErrDegraded) {
+		t.Errorf("expected reason to be recorded; got: %v", err)
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HealthChecker checks if a host is alive. HttpConnection uses it to
+// decide whether it is broken.
+type HealthChecker interface {
+	// Check returns nil if the host at u is alive, and an error describing
+	// the problem otherwise. It must return when ctx is done.
+	Check(ctx context.Context, u *url.URL) error
+}
+
+// HealthCheckerFunc is an adapter to use ordinary functions as HealthChecker.
+type HealthCheckerFunc func(ctx context.Context, u *url.URL) error
+
+// Check calls f(ctx, u).
+func (f HealthCheckerFunc) Check(ctx context.Context, u *url.URL) error {
+	return f(ctx, u)
+}
+
+// ConnectionOption configures a HttpConnection.
+type ConnectionOption func(*HttpConnection)
+
+// WithHealthChecker sets the strategy to check if the host is alive.
+// The default is a HTTPChecker, which can be configured with the other
+// WithHealthCheck options; they are ignored for other checkers.
+func WithHealthChecker(checker HealthChecker) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.checker = checker
+	}
+}
+
+// StatusRange is an inclusive range of HTTP status codes.
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// Contains returns true if code is in the range.
+func (r StatusRange) Contains(code int) bool {
+	return code >= r.Min && code <= r.Max
+}
+
+// HTTPChecker checks if a host is alive by sending a HTTP request and
+// looking at the status code of the response.
+type HTTPChecker struct {
+	// Client sends the request. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// Path of the request, resolved relative to the URL of the host,
+	// i.e. "/_health" replaces the path of the URL while "_health" is
+	// appended to it. It may contain a query string. If empty, the URL
+	// of the host is used as is.
+	Path string
+	// Method of the request. If empty, OPTIONS is used.
+	Method string
+	// Header is added to the request.
+	Header http.Header
+	// Body of the request.
+	Body []byte
+	// UserAgent is sent in the User-Agent header if not empty.
+	UserAgent string
+	// Status is the list of status codes that mark the host as alive.
+	// If empty, only 200 OK is accepted.
+	Status []StatusRange
+	// BodyContains, if not empty, must be a substring of the response body.
+	BodyContains string
+	// BodyMatches, if not nil, must match the response body.
+	BodyMatches *regexp.Regexp
+	// JSONPath, if not empty, is a dot-separated path into the response
+	// body decoded as JSON, e.g. "status" or "nodes.0.state". A leading
+	// "$." is ignored. The value at the path must be one of JSONValues.
+	JSONPath string
+	// JSONValues are the accepted values at JSONPath, e.g. "green" or true.
+	JSONValues []interface{}
+	// DegradedStatus is the list of status codes that mark the host as
+	// alive but degraded. It takes precedence over Status.
+	DegradedStatus []StatusRange
+	// DegradedJSONValues are the values at JSONPath that mark the host as
+	// alive but degraded, e.g. "yellow".
+	DegradedJSONValues []interface{}
+}
+
+// accepts returns true if code is an expected status code.
+func (hc *HTTPChecker) accepts(code int) bool {
+	if len(hc.Status) == 0 {
+		return code == http.StatusOK
+	}
+	for _, r := range hc.Status {
+		if r.Contains(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check sends the health check request to u.
+func (hc *HTTPChecker) Check(ctx context.Context, u *url.URL) error {
+	if hc.Path != "" {
+		ref, err := url.Parse(hc.Path)
+		if err != nil {
+			return fmt.Errorf("invalid health check path %q: %v", hc.Path, err)
+		}
+		u = u.ResolveReference(ref)
+	}
+	method := hc.Method
+	if method == "" {
+		method = "OPTIONS"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(hc.Body))
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %v", u.String(), err)
+	}
+	for k, v := range hc.Header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	if hc.UserAgent != "" {
+		req.Header.Set("User-Agent", hc.UserAgent)
+	}
+
+	client := hc.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %v", u.String(), err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	for _, r := range hc.DegradedStatus {
+		if r.Contains(res.StatusCode) {
+			return fmt.Errorf("%w: request to %s returned status %d", ErrDegraded, u.String(), res.StatusCode)
+		}
+	}
+	if !hc.accepts(res.StatusCode) {
+		return fmt.Errorf("request to %s failed with status %d: %s", u.String(), res.StatusCode, string(body))
+	}
+	if err := hc.checkBody(body); err != nil {
+		if errors.Is(err, ErrDegraded) {
+			return fmt.Errorf("response of %s is %w", u.String(), err)
+		}
+		return fmt.Errorf("response of %s is unhealthy: %v", u.String(), err)
+	}
+	return nil
+}
+
+// checkBody runs the assertions on the response body.
+func (hc *HTTPChecker) checkBody(body []byte) error {
+	if hc.BodyContains != "" && !bytes.Contains(body, []byte(hc.BodyContains)) {
+		return fmt.Errorf("body does not contain %q", hc.BodyContains)
+	}
+	if hc.BodyMatches != nil && !hc.BodyMatches.Match(body) {
+		return fmt.Errorf("body does not match %q", hc.BodyMatches.String())
+	}
+	if hc.JSONPath != "" {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("body is not valid JSON: %v", err)
+		}
+		value, found := lookupJSON(doc, hc.JSONPath)
+		if !found {
+			return fmt.Errorf("body has no value at %q", hc.JSONPath)
+		}
+		for _, expected := range hc.JSONValues {
+			if fmt.Sprint(value) == fmt.Sprint(expected) {
+				return nil
+			}
+		}
+		for _, degraded := range hc.DegradedJSONValues {
+			if fmt.Sprint(value) == fmt.Sprint(degraded) {
+				return fmt.Errorf("%w: value at %q is %v", ErrDegraded, hc.JSONPath, value)
+			}
+		}
+		return fmt.Errorf("value at %q is %v, expected one of %v", hc.JSONPath, value, hc.JSONValues)
+	}
+	return nil
+}
+
+// lookupJSON returns the value at the dot-separated path in doc.
+// Numeric path elements are indices into arrays.
+func lookupJSON(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(path, "$.")
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var found bool
+			if doc, found = v[key]; !found {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// TCPChecker checks if a host is alive by opening a TCP connection to it.
+// If the URL of the host has no port, the default port of its scheme
+// is used.
+type TCPChecker struct {
+	// Dialer opens the connection. If nil, a zero net.Dialer is used.
+	Dialer *net.Dialer
+}
+
+// Check connects to the host of u.
+func (tc *TCPChecker) Check(ctx context.Context, u *url.URL) error {
+	dialer := tc.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	addr := hostPort(u)
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("connect to %s failed: %v", addr, err)
+	}
+	return conn.Close()
+}
+
+// hostPort returns the host and port of u, adding the default port of
+// the scheme if u has none.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// WithHealthCheckPath sets the path of the health check request.
+// See HTTPChecker.Path.
+func WithHealthCheckPath(path string) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.httpChecker.Path = path
+	}
+}
+
+// WithHealthCheckMethod sets the HTTP method of the health check request.
+// The default is OPTIONS.
+func WithHealthCheckMethod(method string) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.httpChecker.Method = method
+	}
+}
+
+// WithHealthCheckHeader adds a header to the health check request.
+func WithHealthCheckHeader(key, value string) ConnectionOption {
+	return func(c *HttpConnection) {
+		if c.httpChecker.Header == nil {
+			c.httpChecker.Header = make(http.Header)
+		}
+		c.httpChecker.Header.Add(key, value)
+	}
+}
+
+// WithHealthCheckBody sets the body of the health check request.
+func WithHealthCheckBody(body []byte) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.httpChecker.Body = append([]byte(nil), body...)
+	}
+}
+
+// WithHealthCheckStatus sets the status codes that mark a host as alive.
+// The default is 200 OK only.
+func WithHealthCheckStatus(ranges ...StatusRange) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.httpChecker.Status = append([]StatusRange(nil), ranges...)
+	}
+}
+
+// WithHealthCheckBodyContains requires the body of the health check
+// response to contain s.
+func WithHealthCheckBodyContains(s string) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.httpChecker.BodyContains = s
+	}
+}
+
+// WithHealthCheckBodyMatches requires the body of the health check
+// response to match re.
+func WithHealthCheckBodyMatches(re *regexp.Regexp) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.httpChecker.BodyMatches = re
+	}
+}
+
+// WithHealthCheckJSON requires the body of the health check response to
+// be JSON with one of values at path, e.g.
+// WithHealthCheckJSON("status", "green", "yellow") for Elasticsearch's
+// cluster health. See HTTPChecker.JSONPath.
+func WithHealthCheckJSON(path string, values ...interface{}) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.httpChecker.JSONPath = path
+		c.httpChecker.JSONValues = values
+	}
+}
+
+// WithHealthCheckDegradedStatus sets the status codes that mark a host
+// as alive but degraded. See HTTPChecker.DegradedStatus.
+func WithHealthCheckDegradedStatus(ranges ...StatusRange) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.httpChecker.DegradedStatus = append([]StatusRange(nil), ranges...)
+	}
+}
+
+// WithHealthCheckDegradedJSON marks a host as alive but degraded if the
+// value at the path of WithHealthCheckJSON is one of values, e.g.
+// WithHealthCheckDegradedJSON("yellow").
+func WithHealthCheckDegradedJSON(values ...interface{}) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.httpChecker.DegradedJSONValues = values
+	}
+}
+
+// WithDegradedLatency marks a host as degraded if its health check
+// succeeds, but takes longer than d. It is disabled by default.
+func WithDegradedLatency(d time.Duration) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.degradedLatency = d
+	}
+}
+
+// WithHealthCheckTimeout sets the time after which a health check is
+// canceled and the host is considered broken. It applies to all health
+// checkers. By default, there is no timeout other than the one of the
+// HTTP client.
+func WithHealthCheckTimeout(timeout time.Duration) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.checkTimeout = timeout
+	}
+}
+
+// WithRiseThreshold sets the number of consecutive successful health
+// checks after which a broken connection becomes healthy again.
+// The default is 1.
+func WithRiseThreshold(n int) ConnectionOption {
+	return func(c *HttpConnection) {
+		if n > 0 {
+			c.rise = n
+		}
+	}
+}
+
+// WithFallThreshold sets the number of consecutive failed health checks
+// after which a healthy connection becomes broken. The default is 1.
+// Notice that the state of a new connection is decided by its first
+// health check alone.
+func WithFallThreshold(n int) ConnectionOption {
+	return func(c *HttpConnection) {
+		if n > 0 {
+			c.fall = n
+		}
+	}
+}
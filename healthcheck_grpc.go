@@ -0,0 +1,167 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Serving states of grpc.health.v1.HealthCheckResponse.
+const (
+	grpcHealthUnknown        = 0
+	grpcHealthServing        = 1
+	grpcHealthNotServing     = 2
+	grpcHealthServiceUnknown = 3
+)
+
+// GRPCChecker checks if a host is alive with the gRPC health checking
+// protocol, i.e. it calls grpc.health.v1.Health/Check and expects the
+// status SERVING. See
+// https://github.com/grpc/grpc/blob/master/doc/health-checking.md.
+type GRPCChecker struct {
+	// Client sends the request. It must support HTTP/2. If nil, a client
+	// is used that speaks HTTP/2 over TLS for https URLs and, if built with
+	// Go 1.24 or later, unencrypted HTTP/2 for http URLs. With earlier
+	// versions of Go, checking http URLs requires a Client that supports
+	// unencrypted HTTP/2, e.g. from golang.org/x/net/http2.
+	Client *http.Client
+	// Service is the name of the service to check. If empty, the overall
+	// health of the server is checked.
+	Service string
+}
+
+// Check calls the gRPC health service of the host at u.
+func (gc *GRPCChecker) Check(ctx context.Context, u *url.URL) error {
+	endpoint := u.ResolveReference(&url.URL{Path: "/grpc.health.v1.Health/Check"})
+
+	// HealthCheckRequest has a single string field "service" with tag 1.
+	var msg []byte
+	if gc.Service != "" {
+		msg = append(msg, 0x0a)
+		msg = binary.AppendUvarint(msg, uint64(len(gc.Service)))
+		msg = append(msg, gc.Service...)
+	}
+	// Length-prefixed message: compression flag and big-endian length.
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %v", endpoint.String(), err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	client := gc.Client
+	if client == nil {
+		if u.Scheme == "http" && !grpcUnencryptedHTTP2 {
+			return fmt.Errorf("health check of %s failed: unencrypted HTTP/2 requires Go 1.24 or GRPCChecker.Client", u.String())
+		}
+		client = grpcClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %v", endpoint.String(), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("request to %s failed with status %d", endpoint.String(), res.StatusCode)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %v", endpoint.String(), err)
+	}
+
+	// The gRPC status is sent in the trailers, or in the headers if the
+	// response has no body.
+	status := res.Trailer.Get("Grpc-Status")
+	message := res.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = res.Header.Get("Grpc-Status")
+		message = res.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return fmt.Errorf("health check of %s failed with gRPC status %s: %s", u.String(), status, message)
+	}
+
+	serving, err := parseGRPCHealthResponse(data)
+	if err != nil {
+		return fmt.Errorf("health check of %s failed: %v", u.String(), err)
+	}
+	switch serving {
+	case grpcHealthServing:
+		return nil
+	case grpcHealthNotServing:
+		return fmt.Errorf("health check of %s failed: NOT_SERVING", u.String())
+	case grpcHealthServiceUnknown:
+		return fmt.Errorf("health check of %s failed: SERVICE_UNKNOWN", u.String())
+	default:
+		return fmt.Errorf("health check of %s failed: UNKNOWN", u.String())
+	}
+}
+
+// parseGRPCHealthResponse returns the serving status of a length-prefixed
+// grpc.health.v1.HealthCheckResponse message.
+func parseGRPCHealthResponse(data []byte) (uint64, error) {
+	if len(data) < 5 {
+		return 0, errors.New("short gRPC response")
+	}
+	if data[0] != 0 {
+		return 0, errors.New("compressed gRPC responses are not supported")
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < n {
+		return 0, errors.New("short gRPC response")
+	}
+	msg := data[5 : 5+n]
+
+	// HealthCheckResponse has a single enum field "status" with tag 1.
+	// Skip all other fields.
+	status := uint64(grpcHealthUnknown)
+	for len(msg) > 0 {
+		key, k := binary.Uvarint(msg)
+		if k <= 0 {
+			return 0, errors.New("invalid gRPC response")
+		}
+		msg = msg[k:]
+		switch key & 7 {
+		case 0: // varint
+			v, k := binary.Uvarint(msg)
+			if k <= 0 {
+				return 0, errors.New("invalid gRPC response")
+			}
+			msg = msg[k:]
+			if key>>3 == 1 {
+				status = v
+			}
+		case 1: // 64-bit
+			if len(msg) < 8 {
+				return 0, errors.New("invalid gRPC response")
+			}
+			msg = msg[8:]
+		case 2: // length-delimited
+			l, k := binary.Uvarint(msg)
+			if k <= 0 || uint64(len(msg)-k) < l {
+				return 0, errors.New("invalid gRPC response")
+			}
+			msg = msg[k+int(l):]
+		case 5: // 32-bit
+			if len(msg) < 4 {
+				return 0, errors.New("invalid gRPC response")
+			}
+			msg = msg[4:]
+		default:
+			return 0, errors.New("invalid gRPC response")
+		}
+	}
+	return status, nil
+}
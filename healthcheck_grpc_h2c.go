@@ -0,0 +1,25 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+//go:build go1.24
+
+package balancers
+
+import "net/http"
+
+// grpcUnencryptedHTTP2 is true if grpcClient supports unencrypted HTTP/2.
+const grpcUnencryptedHTTP2 = true
+
+// grpcClient is the default client of GRPCChecker. It speaks HTTP/2 over
+// TLS for https URLs and HTTP/2 with prior knowledge for http URLs.
+var grpcClient = func() *http.Client {
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{
+		Transport: &http.Transport{
+			Protocols: &protocols,
+		},
+	}
+}()
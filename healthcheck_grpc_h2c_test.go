@@ -0,0 +1,33 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+//go:build go1.24
+
+package balancers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGRPCCheckerWithUnencryptedHTTP2(t *testing.T) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	server := httptest.NewUnstartedServer(grpcHealthHandler(t, grpcHealthNotServing))
+	server.Config.Protocols = &protocols
+	server.Start()
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	checker := &GRPCChecker{Service: "search"}
+	err := checker.Check(context.Background(), u)
+	if err == nil || !strings.Contains(err.Error(), "NOT_SERVING") {
+		t.Errorf("expected NOT_SERVING host to be unhealthy; got: %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+//go:build !go1.24
+
+package balancers
+
+import "net/http"
+
+// grpcUnencryptedHTTP2 is true if grpcClient supports unencrypted HTTP/2.
+// net/http only supports it as of Go 1.24.
+const grpcUnencryptedHTTP2 = false
+
+// grpcClient is the default client of GRPCChecker. It speaks HTTP/2 over
+// TLS for https URLs.
+var grpcClient = &http.Client{
+	Transport: &http.Transport{
+		ForceAttemptHTTP2: true,
+	},
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+//go:build !go1.24
+
+package balancers
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGRPCCheckerRequiresClientForUnencryptedHTTP2(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	checker := &GRPCChecker{}
+	err := checker.Check(context.Background(), u)
+	if err == nil || !strings.Contains(err.Error(), "GRPCChecker.Client") {
+		t.Errorf("expected error asking for a client; got: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPChecker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ok" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	tests := []struct {
+		Checker *HTTPChecker
+		Healthy bool
+	}{
+		{&HTTPChecker{}, false},
+		{&HTTPChecker{Path: "/ok"}, false},
+		{&HTTPChecker{Path: "/ok", Status: []StatusRange{{200, 299}}}, true},
+		{&HTTPChecker{Status: []StatusRange{{500, 599}}}, true},
+	}
+	for i, test := range tests {
+		err := test.Checker.Check(context.Background(), u)
+		if test.Healthy && err != nil {
+			t.Errorf("#%d: expected host to be healthy; got: %v", i, err)
+		}
+		if !test.Healthy && err == nil {
+			t.Errorf("#%d: expected host to be unhealthy", i)
+		}
+	}
+}
+
+func TestHTTPCheckerBodyAssertions(t *testing.T) {
+	body := `{"cluster_name":"search","status":"red","nodes":[{"state":"up"}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	tests := []struct {
+		Checker *HTTPChecker
+		Healthy bool
+	}{
+		{&HTTPChecker{BodyContains: `"cluster_name":"search"`}, true},
+		{&HTTPChecker{BodyContains: `"status":"green"`}, false},
+		{&HTTPChecker{BodyMatches: regexp.MustCompile(`"status":"(green|yellow|red)"`)}, true},
+		{&HTTPChecker{BodyMatches: regexp.MustCompile(`"status":"(green|yellow)"`)}, false},
+		{&HTTPChecker{JSONPath: "status", JSONValues: []interface{}{"green", "yellow"}}, false},
+		{&HTTPChecker{JSONPath: "$.status", JSONValues: []interface{}{"red"}}, true},
+		{&HTTPChecker{JSONPath: "nodes.0.state", JSONValues: []interface{}{"up"}}, true},
+		{&HTTPChecker{JSONPath: "nodes.1.state", JSONValues: []interface{}{"up"}}, false},
+		{&HTTPChecker{JSONPath: "missing", JSONValues: []interface{}{"up"}}, false},
+	}
+	for i, test := range tests {
+		err := test.Checker.Check(context.Background(), u)
+		if test.Healthy && err != nil {
+			t.Errorf("#%d: expected host to be healthy; got: %v", i, err)
+		}
+		if !test.Healthy && err == nil {
+			t.Errorf("#%d: expected host to be unhealthy", i)
+		}
+	}
+}
+
+func TestHttpConnectionRecordsHealthCheckFailure(t *testing.T) {
+	status := "red"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"` + status + `"}`))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	conn := NewHttpConnection(u, http.DefaultClient, 30*time.Second, 5*time.Minute,
+		WithHealthCheckJSON("status", "green", "yellow"),
+	)
+	defer conn.Close()
+	if !conn.IsBroken() {
+		t.Fatal("expected connection to be broken")
+	}
+	err := conn.LastError()
+	if err == nil || !strings.Contains(err.Error(), `value at "status" is red`) {
+		t.Errorf("expected failure reason to be recorded; got: %v", err)
+	}
+
+	status = "yellow"
+	conn.checkBroken()
+	if conn.IsBroken() {
+		t.Error("expected connection to not be broken")
+	}
+	if err := conn.LastError(); err != nil {
+		t.Errorf("expected no failure reason; got: %v", err)
+	}
+}
+
+func TestTCPChecker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("http://" + l.Addr().String())
+
+	checker := &TCPChecker{}
+	if err := checker.Check(context.Background(), u); err != nil {
+		t.Errorf("expected host to be healthy; got: %v", err)
+	}
+	l.Close()
+	if err := checker.Check(context.Background(), u); err == nil {
+		t.Error("expected host to be unhealthy")
+	}
+}
+
+// grpcHealthHandler implements grpc.health.v1.Health/Check, responding
+// with the given serving status for all services but "unknown".
+func grpcHealthHandler(t *testing.T, serving byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/grpc.health.v1.Health/Check" || r.ProtoMajor != 2 {
+			t.Errorf("unexpected request %s %s", r.Proto, r.URL.Path)
+		}
+		buf := make([]byte, 64)
+		n, _ := r.Body.Read(buf)
+		service := ""
+		if n > 7 {
+			service = string(buf[7:n])
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		if service == "unknown" {
+			w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+			w.WriteHeader(http.StatusOK)
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "unknown service")
+			return
+		}
+		msg := []byte{0x08, serving}
+		res := make([]byte, 5)
+		binary.BigEndian.PutUint32(res[1:], uint32(len(msg)))
+		w.Write(append(res, msg...))
+		w.Header().Set("Grpc-Status", "0")
+	}
+}
+
+func TestGRPCCheckerOverTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(grpcHealthHandler(t, grpcHealthServing))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	checker := &GRPCChecker{Client: server.Client()}
+	if err := checker.Check(context.Background(), u); err != nil {
+		t.Errorf("expected host to be healthy; got: %v", err)
+	}
+	checker.Service = "unknown"
+	err := checker.Check(context.Background(), u)
+	if err == nil || !strings.Contains(err.Error(), "gRPC status 5") {
+		t.Errorf("expected unknown service to be unhealthy; got: %v", err)
+	}
+}
+
+func TestHttpConnectionWithHealthChecker(t *testing.T) {
+	var checked *url.URL
+	healthy := true
+	checker := HealthCheckerFunc(func(ctx context.Context, u *url.URL) error {
+		checked = u
+		if !healthy {
+			return errors.New("down")
+		}
+		return nil
+	})
+
+	u, _ := url.Parse("http://localhost:12345")
+	conn := NewHttpConnection(u, http.DefaultClient, 30*time.Second, 5*time.Minute, WithHealthChecker(checker))
+	defer conn.Close()
+	if conn.IsBroken() {
+		t.Error("expected connection to not be broken")
+	}
+	if checked != u {
+		t.Errorf("expected checker to be called with %v; got: %v", u, checked)
+	}
+
+	healthy = false
+	conn.checkBroken()
+	if !conn.IsBroken() {
+		t.Error("expected connection to be broken")
+	}
+}
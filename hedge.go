@@ -0,0 +1,232 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultHedgeFraction is the maximum fraction of requests that are
+// hedged if HedgePolicy.MaxFraction is not set.
+const DefaultHedgeFraction = 0.1
+
+const (
+	hedgeSamples    = 128 // number of recent latencies kept
+	hedgeMinSamples = 20  // latencies needed before Percentile is used
+	hedgeRecompute  = 16  // latencies observed before Percentile is updated
+	hedgeBurst      = 100 // requests over which hedges may be bunched
+)
+
+// HedgePolicy decides when Transport sends a second copy of a request
+// to another connection. See WithHedging.
+type HedgePolicy struct {
+	// Delay is the time to wait for the response headers of a request
+	// before a hedged copy is sent.
+	Delay time.Duration
+	// Percentile, if between 0 and 1, makes the delay follow the latency
+	// of recent requests: the delay is the given percentile, e.g. 0.95,
+	// of the time it took to receive response headers. Delay is used
+	// until enough requests have been observed.
+	Percentile float64
+	// MaxFraction is the maximum fraction of requests that are hedged,
+	// e.g. 0.1 for 10%. If zero, DefaultHedgeFraction is used.
+	MaxFraction float64
+}
+
+// WithHedging makes Transport send a second copy of a request to another
+// connection if the response headers have not been received after the
+// delay of the policy. Whichever response arrives first is returned, and
+// the other request is canceled.
+//
+// Only idempotent requests are hedged (see WithIdempotentMethods), and
+// requests with a body only if it can be sent twice (see WithBodyBuffer).
+// Hedged requests count against the retry budget, if any; see
+// WithRetryBudget.
+func WithHedging(policy *HedgePolicy) TransportOption {
+	return func(t *Transport) {
+		if policy == nil {
+			t.hedge = nil
+			return
+		}
+		t.hedge = newHedger(*policy)
+	}
+}
+
+// hedger keeps track of the latencies and the number of hedged requests
+// of a Transport.
+type hedger struct {
+	policy   HedgePolicy
+	maxBurst float64
+
+	mu         sync.Mutex
+	samples    [hedgeSamples]time.Duration
+	observed   int           // total number of latencies observed
+	percentile time.Duration // cached percentile of samples
+	computedAt int           // value of observed when percentile was computed
+	tokens     float64       // hedges that may be sent
+}
+
+func newHedger(policy HedgePolicy) *hedger {
+	if policy.MaxFraction <= 0 {
+		policy.MaxFraction = DefaultHedgeFraction
+	}
+	h := &hedger{
+		policy:   policy,
+		maxBurst: math.Max(1, policy.MaxFraction*hedgeBurst),
+	}
+	h.tokens = h.maxBurst
+	return h
+}
+
+// observe records the time it took to receive response headers.
+func (h *hedger) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.observed%hedgeSamples] = d
+	h.observed++
+}
+
+// delay returns the time to wait before a request is hedged.
+func (h *hedger) delay() time.Duration {
+	p := h.policy.Percentile
+	if p <= 0 || p >= 1 {
+		return h.policy.Delay
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.observed < hedgeMinSamples {
+		return h.policy.Delay
+	}
+	if h.percentile == 0 || h.observed-h.computedAt >= hedgeRecompute {
+		n := h.observed
+		if n > hedgeSamples {
+			n = hedgeSamples
+		}
+		sorted := make([]time.Duration, n)
+		copy(sorted, h.samples[:n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		h.percentile = sorted[int(math.Ceil(p*float64(n)))-1]
+		h.computedAt = h.observed
+	}
+	return h.percentile
+}
+
+// started records that a request that may be hedged has been started.
+func (h *hedger) started() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens = math.Min(h.tokens+h.policy.MaxFraction, h.maxBurst)
+}
+
+// allow returns true if another request may be hedged without exceeding
+// the maximum fraction of hedged requests.
+func (h *hedger) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens+tokenEpsilon < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// hedgeResult is the outcome of one of the copies of a hedged request.
+type hedgeResult struct {
+	res *http.Response
+	err error
+	idx int // index of the copy
+}
+
+// send sends r with the given body to conn, and hedges it if possible.
+// Connections that r is sent to are added to tried.
+func (t *Transport) send(r *http.Request, b *requestBody, body io.ReadCloser, conn Connection, tried map[Connection]bool, wt *writeTrace) (*http.Response, error) {
+	if t.hedge == nil || !t.idempotent(r) || !b.replayable() {
+		return t.roundTrip(r.Context(), r, body, conn, wt)
+	}
+	t.hedge.started()
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	start := func(body io.ReadCloser, conn Connection) {
+		ctx, cancel := context.WithCancel(r.Context())
+		idx := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			res, err := t.roundTrip(ctx, r, body, conn, nil)
+			results <- hedgeResult{res: res, err: err, idx: idx}
+		}()
+	}
+	start(body, conn)
+	pending := 1
+
+	timer := time.NewTimer(t.hedge.delay())
+	defer timer.Stop()
+	timeout := timer.C
+
+	var winner *hedgeResult
+	var err error
+	for pending > 0 && winner == nil {
+		select {
+		case <-timeout:
+			timeout = nil
+			if !t.hedge.allow() {
+				continue
+			}
+			next := t.next(r, tried)
+			if next == nil {
+				continue
+			}
+			if t.budget != nil && !t.budget.withdraw() {
+				continue
+			}
+			rb, rerr := b.replay()
+			if rerr != nil {
+				t.refund()
+				continue
+			}
+			tried[next] = true
+			start(rb, next)
+			pending++
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				cancels[result.idx]()
+				if err == nil {
+					err = result.err
+				}
+				continue
+			}
+			winner = &result
+		}
+	}
+
+	// Cancel the copy that lost, if any.
+	for idx, cancel := range cancels {
+		if winner == nil || idx != winner.idx {
+			cancel()
+		}
+	}
+	if pending > 0 {
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if result := <-results; result.res != nil {
+					result.res.Body.Close()
+				}
+			}
+		}(pending)
+	}
+	if winner == nil {
+		return nil, err
+	}
+	res := winner.res
+	res.Body = &onEOFReader{rc: res.Body, fn: cancels[winner.idx]}
+	return res, nil
+}
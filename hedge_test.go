@@ -0,0 +1,157 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// respondAfter returns a handler that responds after delay, or when
+// the request is canceled, which it reports on canceled.
+func respondAfter(delay time.Duration, canceled chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+			io.WriteString(w, delay.String())
+		case <-r.Context().Done():
+			if canceled != nil {
+				canceled <- struct{}{}
+			}
+		}
+	}
+}
+
+func TestTransportHedgesSlowRequests(t *testing.T) {
+	var slowRequests, fastRequests atomic.Int32
+	canceled := make(chan struct{}, 1)
+	slow := newTestServer(&slowRequests, respondAfter(10*time.Second, canceled))
+	defer slow.Close()
+	fast := newTestServer(&fastRequests, respondAfter(0, nil))
+	defer fast.Close()
+
+	// Failures of the canceled copy must not eject the slow host.
+	detector := NewOutlierDetector(WithConsecutiveFailures(1), WithMaxEjectionPercent(100))
+	conn1 := newHealthyConn(t, slow.URL, WithOutlierDetector(detector))
+	conn2 := newHealthyConn(t, fast.URL, WithOutlierDetector(detector))
+	balancer := &testRoundRobin{conns: []Connection{conn1, conn2}}
+	client := &http.Client{Transport: NewTransport(balancer, WithHedging(&HedgePolicy{Delay: 20 * time.Millisecond}))}
+
+	start := time.Now()
+	res, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "0s" {
+		t.Errorf("expected response of the fast host; got: %q", body)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected hedged request to return early; took %v", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("expected slow request to be canceled")
+	}
+	if slowRequests.Load() != 1 || fastRequests.Load() != 1 {
+		t.Errorf("expected 1 request to each host; got: %d and %d", slowRequests.Load(), fastRequests.Load())
+	}
+	if conn1.IsEjected() {
+		t.Error("expected canceled host not to be ejected")
+	}
+}
+
+func TestTransportDoesNotHedgeFastRequests(t *testing.T) {
+	var requests1, requests2 atomic.Int32
+	server1 := newTestServer(&requests1, respondAfter(0, nil))
+	defer server1.Close()
+	server2 := newTestServer(&requests2, respondAfter(0, nil))
+	defer server2.Close()
+
+	balancer := &testRoundRobin{conns: []Connection{newHealthyConn(t, server1.URL), newHealthyConn(t, server2.URL)}}
+	client := &http.Client{Transport: NewTransport(balancer, WithHedging(&HedgePolicy{Delay: time.Second}))}
+
+	res, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if requests1.Load() != 1 || requests2.Load() != 0 {
+		t.Errorf("expected no hedged request; got: %d and %d", requests1.Load(), requests2.Load())
+	}
+}
+
+func TestTransportDoesNotHedgeNonIdempotentRequests(t *testing.T) {
+	var slowRequests, fastRequests atomic.Int32
+	slow := newTestServer(&slowRequests, respondAfter(100*time.Millisecond, nil))
+	defer slow.Close()
+	fast := newTestServer(&fastRequests, respondAfter(0, nil))
+	defer fast.Close()
+
+	balancer := &testRoundRobin{conns: []Connection{newHealthyConn(t, slow.URL), newHealthyConn(t, fast.URL)}}
+	client := &http.Client{Transport: NewTransport(balancer, WithHedging(&HedgePolicy{Delay: time.Millisecond}))}
+
+	res, err := client.Post("http://localhost/", "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if slowRequests.Load() != 1 || fastRequests.Load() != 0 {
+		t.Errorf("expected no hedged request; got: %d and %d", slowRequests.Load(), fastRequests.Load())
+	}
+}
+
+func TestTransportHedgeFraction(t *testing.T) {
+	var slowRequests, fastRequests atomic.Int32
+	slow := newTestServer(&slowRequests, respondAfter(100*time.Millisecond, nil))
+	defer slow.Close()
+	fast := newTestServer(&fastRequests, respondAfter(0, nil))
+	defer fast.Close()
+
+	balancer := &testRoundRobin{conns: []Connection{newHealthyConn(t, slow.URL), newHealthyConn(t, fast.URL)}}
+	policy := &HedgePolicy{Delay: time.Millisecond, MaxFraction: 0.01}
+	client := &http.Client{Transport: NewTransport(balancer, WithHedging(policy))}
+
+	for i := 0; i < 3; i++ {
+		balancer.idx = 0
+		res, err := client.Get("http://localhost/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if fastRequests.Load() != 1 {
+		t.Errorf("expected only the first request to be hedged; got %d hedged requests", fastRequests.Load())
+	}
+}
+
+func TestHedgerDelay(t *testing.T) {
+	h := newHedger(HedgePolicy{Delay: time.Second, Percentile: 0.9})
+	for i := 1; i < hedgeMinSamples; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if got := h.delay(); got != time.Second {
+		t.Errorf("expected Delay with too few samples; got: %v", got)
+	}
+	for i := hedgeMinSamples; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if got, want := h.delay(), 90*time.Millisecond; got != want {
+		t.Errorf("expected %v; got: %v", want, got)
+	}
+
+	// Old samples are forgotten.
+	for i := 0; i < hedgeSamples; i++ {
+		h.observe(time.Second)
+	}
+	if got, want := h.delay(), time.Second; got != want {
+		t.Errorf("expected %v; got: %v", want, got)
+	}
+}
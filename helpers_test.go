@@ -0,0 +1,47 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newHealthyConn returns a connection to rawurl with a health check that
+// always succeeds, and the given options, e.g. WithOutlierDetector. The
+// connection is closed when the test finishes.
+func newHealthyConn(t *testing.T, rawurl string, opts ...ConnectionOption) *HttpConnection {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthy := HealthCheckerFunc(func(context.Context, *url.URL) error { return nil })
+	conn := NewHttpConnection(u, http.DefaultClient, 30*time.Second, 5*time.Minute,
+		append([]ConnectionOption{WithHealthChecker(healthy)}, opts...)...)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// newTestServer returns a server that serves requests with handler and
+// counts them in requests, if not nil.
+func newTestServer(requests *atomic.Int32, handler http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil {
+			requests.Add(1)
+		}
+		handler(w, r)
+	}))
+}
+
+// respondWith returns a handler that responds with status.
+func respondWith(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}
+}
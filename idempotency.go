@@ -0,0 +1,104 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+var (
+	// DefaultIdempotentMethods are the methods of requests that Transport
+	// retries by default, even if a previous attempt may have reached the
+	// host.
+	DefaultIdempotentMethods = []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE"}
+
+	// DefaultIdempotencyKey is the header that marks requests with other
+	// methods as safe to retry by default.
+	DefaultIdempotencyKey = "Idempotency-Key"
+)
+
+// WithIdempotentMethods sets the methods of requests that Transport may
+// send again after a previous attempt may have reached the host, e.g.
+// after the host responded with 502 Bad Gateway. Requests with other
+// methods, e.g. POST and PATCH, are only retried if they have an
+// idempotency key (see WithIdempotencyKey) or if the previous attempt
+// failed before any bytes have been written. The default is
+// DefaultIdempotentMethods.
+func WithIdempotentMethods(methods ...string) TransportOption {
+	return func(t *Transport) {
+		t.idempotentMethods = methodSet(methods)
+	}
+}
+
+// WithIdempotencyKey sets the header that marks requests as safe to
+// retry, regardless of their method. An empty header disables idempotency
+// keys. The default is DefaultIdempotencyKey.
+func WithIdempotencyKey(header string) TransportOption {
+	return func(t *Transport) {
+		t.idempotencyKey = header
+	}
+}
+
+func methodSet(methods []string) map[string]bool {
+	set := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		set[method] = true
+	}
+	return set
+}
+
+// idempotent returns true if r may be sent again, even if a previous
+// attempt may have reached the host.
+func (t *Transport) idempotent(r *http.Request) bool {
+	method := r.Method
+	if method == "" {
+		method = "GET"
+	}
+	if t.idempotentMethods[method] {
+		return true
+	}
+	return t.idempotencyKey != "" && r.Header.Get(t.idempotencyKey) != ""
+}
+
+// resendable returns true if r may be sent again after its last attempt,
+// traced by wt, failed with err.
+func (t *Transport) resendable(r *http.Request, err error, wt *writeTrace) bool {
+	if t.idempotent(r) {
+		return true
+	}
+	return err != nil && wt != nil && wt.unsent()
+}
+
+// writeTrace records whether any bytes of a request have been written.
+type writeTrace struct {
+	started atomic.Bool // true if the base transport supports tracing
+	wrote   atomic.Bool
+}
+
+// reset prepares wt for the next attempt.
+func (wt *writeTrace) reset() {
+	wt.started.Store(false)
+	wt.wrote.Store(false)
+}
+
+// clientTrace returns the hooks that update wt.
+func (wt *writeTrace) clientTrace() *httptrace.ClientTrace {
+	wrote := func() { wt.wrote.Store(true) }
+	return &httptrace.ClientTrace{
+		GetConn:          func(string) { wt.started.Store(true) },
+		WroteHeaderField: func(string, []string) { wrote() },
+		WroteHeaders:     wrote,
+		Wait100Continue:  wrote,
+		WroteRequest:     func(httptrace.WroteRequestInfo) { wrote() },
+	}
+}
+
+// unsent returns true if the attempt certainly failed before any bytes
+// were written. Base transports that do not support httptrace never
+// report requests as unsent.
+func (wt *writeTrace) unsent() bool {
+	return wt.started.Load() && !wt.wrote.Load()
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+func TestTransportRetriesIdempotentRequests(t *testing.T) {
+	tests := []struct {
+		Method  string
+		Header  string
+		Options []TransportOption
+		Retried bool
+	}{
+		{Method: "GET", Retried: true},
+		{Method: "HEAD", Retried: true},
+		{Method: "OPTIONS", Retried: true},
+		{Method: "PUT", Retried: true},
+		{Method: "DELETE", Retried: true},
+		{Method: "POST", Retried: false},
+		{Method: "PATCH", Retried: false},
+		{Method: "POST", Header: "Idempotency-Key", Retried: true},
+		{Method: "PATCH", Header: "Idempotency-Key", Retried: true},
+		{Method: "POST", Header: "X-Request-Id", Options: []TransportOption{WithIdempotencyKey("X-Request-Id")}, Retried: true},
+		{Method: "POST", Header: "Idempotency-Key", Options: []TransportOption{WithIdempotencyKey("")}, Retried: false},
+		{Method: "PUT", Options: []TransportOption{WithIdempotentMethods("GET")}, Retried: false},
+		{Method: "POST", Options: []TransportOption{WithIdempotentMethods("POST")}, Retried: true},
+	}
+	for _, test := range tests {
+		var failed, ok atomic.Int32
+		server1 := newTestServer(&failed, respondWith(http.StatusBadGateway))
+		server2 := newTestServer(&ok, respondWith(http.StatusOK))
+
+		balancer := &testRoundRobin{conns: []Connection{newHealthyConn(t, server1.URL), newHealthyConn(t, server2.URL)}}
+		opts := append([]TransportOption{WithRetryPolicy(&RetryPolicy{MaxAttempts: 2})}, test.Options...)
+		client := &http.Client{Transport: NewTransport(balancer, opts...)}
+
+		req, _ := http.NewRequest(test.Method, "http://localhost/", strings.NewReader("body"))
+		if test.Header != "" {
+			req.Header.Set(test.Header, "42")
+		}
+		res, err := client.Do(req)
+		server1.Close()
+		server2.Close()
+		if err != nil {
+			t.Errorf("%s %s: %v", test.Method, test.Header, err)
+			continue
+		}
+		res.Body.Close()
+
+		if test.Retried && (res.StatusCode != http.StatusOK || ok.Load() != 1) {
+			t.Errorf("%s %s: expected retry; got: %d", test.Method, test.Header, res.StatusCode)
+		}
+		if !test.Retried && (res.StatusCode != http.StatusBadGateway || ok.Load() != 0) {
+			t.Errorf("%s %s: expected no retry; got: %d", test.Method, test.Header, res.StatusCode)
+		}
+	}
+}
+
+func TestTransportRetriesUnsentRequests(t *testing.T) {
+	var bodies []string
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up := newTestServer(nil, recordBody(http.StatusOK, &bodies))
+	defer up.Close()
+
+	// Connecting to the first host fails, so the POST has not been sent.
+	balancer := &testRoundRobin{conns: []Connection{newHealthyConn(t, down.URL), newHealthyConn(t, up.URL)}}
+	client := &http.Client{Transport: NewTransport(balancer, WithRetryPolicy(&RetryPolicy{MaxAttempts: 2}))}
+
+	res, err := client.Post("http://localhost/", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("expected request to be retried; got: %v", err)
+	}
+	res.Body.Close()
+	if len(bodies) != 1 || bodies[0] != "hello" {
+		t.Errorf("expected second host to receive the body; got: %q", bodies)
+	}
+}
+
+func TestTransportDoesNotRetryUntracedRequests(t *testing.T) {
+	var requests atomic.Int32
+	up := newTestServer(&requests, respondWith(http.StatusOK))
+	defer up.Close()
+
+	// A base transport without httptrace support cannot tell whether the
+	// request has been written.
+	failure := errors.New("failure")
+	attempts := 0
+	transport := NewTransport(
+		&testRoundRobin{conns: []Connection{newHealthyConn(t, "http://127.0.0.1:1"), newHealthyConn(t, up.URL)}},
+		WithRetryPolicy(&RetryPolicy{MaxAttempts: 2}),
+	)
+	transport.Base = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		return nil, failure
+	})
+	client := &http.Client{Transport: transport}
+
+	_, err := client.Post("http://localhost/", "text/plain", strings.NewReader("hello"))
+	if !errors.Is(err, failure) {
+		t.Errorf("expected %v; got: %v", failure, err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected no retry; got %d attempts", attempts)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancertest_test
+
+import (
+	"testing"
+
+	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/consistenthash"
+	"github.com/tianlin/balancers/internal/balancertest"
+	"github.com/tianlin/balancers/leastconn"
+	"github.com/tianlin/balancers/maglev"
+	"github.com/tianlin/balancers/p2c"
+	"github.com/tianlin/balancers/peakewma"
+	"github.com/tianlin/balancers/random"
+	"github.com/tianlin/balancers/rendezvous"
+	"github.com/tianlin/balancers/roundrobin"
+	"github.com/tianlin/balancers/weighted"
+	"github.com/tianlin/balancers/weightedrandom"
+)
+
+var constructors = []struct {
+	Name        string
+	NewBalancer func(...balancers.Connection) (balancers.Balancer, error)
+}{
+	{"consistenthash", consistenthash.NewBalancer},
+	{"leastconn", leastconn.NewBalancer},
+	{"maglev", maglev.NewBalancer},
+	{"p2c", p2c.NewBalancer},
+	{"peakewma", peakewma.NewBalancer},
+	{"random", random.NewBalancer},
+	{"rendezvous", rendezvous.NewBalancer},
+	{"roundrobin", roundrobin.NewBalancer},
+	{"weighted", weighted.NewBalancer},
+	{"weightedrandom", weightedrandom.NewBalancer},
+}
+
+func TestBalancerPrefersHealthyConnections(t *testing.T) {
+	for _, test := range constructors {
+		a := balancertest.NewConn("http://a")
+		b := balancertest.NewConn("http://b")
+		a.State = balancers.Degraded
+		// Health comes before load.
+		b.Pending = 5
+
+		balancer, err := test.NewBalancer(a, b)
+		if err != nil {
+			t.Fatalf("%s: %v", test.Name, err)
+		}
+		for i := 0; i < 10; i++ {
+			conn, err := balancer.Get()
+			if err != nil {
+				t.Fatalf("%s: %v", test.Name, err)
+			}
+			if conn != b {
+				t.Fatalf("%s: expected healthy connection %q; got: %q", test.Name, b.URL(), conn.URL())
+			}
+		}
+
+		// Degraded connections are used when no healthy one is left.
+		b.Broken = true
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatalf("%s: %v", test.Name, err)
+		}
+		if conn != a {
+			t.Errorf("%s: expected degraded connection %q; got: %q", test.Name, a.URL(), conn.URL())
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+// Package balancertest provides a fake connection for testing the
+// balancers of this module.
+package balancertest
+
+import (
+	"net/url"
+
+	"github.com/tianlin/balancers"
+)
+
+// Conn is a connection whose state is set by the test. It implements
+// all optional connection interfaces of the balancers package.
+type Conn struct {
+	url *url.URL
+
+	Broken  bool             // returned by IsBroken
+	State   balancers.Health // returned by Health
+	Pending int              // returned by Inflight
+	Share   int              // returned by Weight
+	Factor  float64          // returned by SlowStartFactor
+}
+
+// NewConn creates a healthy connection to rawurl with a weight and a
+// slow-start factor of 1 and no requests in flight.
+func NewConn(rawurl string) *Conn {
+	u, _ := url.Parse(rawurl)
+	return &Conn{url: u, Share: 1, Factor: 1}
+}
+
+func (c *Conn) URL() *url.URL            { return c.url }
+func (c *Conn) IsBroken() bool           { return c.Broken }
+func (c *Conn) Health() balancers.Health { return c.State }
+func (c *Conn) Weight() int              { return c.Share }
+func (c *Conn) SlowStartFactor() float64 { return c.Factor }
+func (c *Conn) RequestStarted()          { c.Pending++ }
+func (c *Conn) RequestFinished()         { c.Pending-- }
+func (c *Conn) Inflight() int            { return c.Pending }
@@ -0,0 +1,55 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"net/http"
+)
+
+// KeyFunc extracts the key from a request that hash-based balancers use
+// to choose a connection. Requests with the same key are sent to the
+// same connection as long as it is available.
+type KeyFunc func(r *http.Request) string
+
+// PathKey uses the URL path of the request as the key.
+func PathKey(r *http.Request) string {
+	if r == nil || r.URL == nil {
+		return ""
+	}
+	return r.URL.Path
+}
+
+// HeaderKey uses the value of the given request header as the key.
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if r == nil {
+			return ""
+		}
+		return r.Header.Get(name)
+	}
+}
+
+// CookieKey uses the value of the given cookie as the key.
+func CookieKey(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if r == nil {
+			return ""
+		}
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+}
+
+// QueryKey uses the value of the given query parameter as the key.
+func QueryKey(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if r == nil || r.URL == nil {
+			return ""
+		}
+		return r.URL.Query().Get(name)
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestKeyFuncs(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost/path?tenant=q", nil)
+	req.Header.Set("X-Tenant", "h")
+	req.AddCookie(&http.Cookie{Name: "tenant", Value: "c"})
+
+	tests := []struct {
+		Key      KeyFunc
+		Expected string
+	}{
+		{PathKey, "/path"},
+		{HeaderKey("X-Tenant"), "h"},
+		{CookieKey("tenant"), "c"},
+		{CookieKey("missing"), ""},
+		{QueryKey("tenant"), "q"},
+	}
+	for i, test := range tests {
+		if got := test.Key(req); got != test.Expected {
+			t.Errorf("#%d: expected key %q; got: %q", i, test.Expected, got)
+		}
+		if got := test.Key(nil); got != "" {
+			t.Errorf("#%d: expected empty key for nil request; got: %q", i, got)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+// Package leastconn implements a balancer that picks the connection
+// with the fewest requests in flight.
+package leastconn
+
+import (
+	"sync"
+
+	"github.com/tianlin/balancers"
+)
+
+// Balancer implements a least-outstanding-requests balancer.
+//
+// The number of requests in flight is taken from connections implementing
+// balancers.InflightTracker, e.g. balancers.HttpConnection. It is updated
+// by balancers.Transport, so the balancer must be used with a client
+// created by balancers.NewClient. Ties are broken in a round-robin fashion.
+type Balancer struct {
+	sync.Mutex // guards the following variables
+	conns      []balancers.Connection
+	idx        int // index into conns where the next scan starts
+}
+
+// NewBalancer creates a new least-connections balancer. It can be
+// initialized by a variable number of connections.
+func NewBalancer(conns ...balancers.Connection) (balancers.Balancer, error) {
+	b := &Balancer{
+		conns: make([]balancers.Connection, 0),
+	}
+	if len(conns) > 0 {
+		b.conns = append(b.conns, conns...)
+	}
+	return b, nil
+}
+
+// Get returns the connection with the fewest requests in flight.
+// ErrNoConn is returned when no connection is available.
+func (b *Balancer) Get() (balancers.Connection, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.conns) == 0 {
+		return nil, balancers.ErrNoConn
+	}
+
+	// Healthy connections always win over degraded ones.
+	var conn balancers.Connection
+	var health balancers.Health
+	min := 0
+	for i := 0; i < len(b.conns); i++ {
+		candidate := b.conns[(b.idx+i)%len(b.conns)]
+		h := balancers.HealthOf(candidate)
+		if h == balancers.Unhealthy {
+			continue
+		}
+		if n := balancers.InflightOf(candidate); conn == nil || h < health || (h == health && n < min) {
+			conn = candidate
+			health = h
+			min = n
+		}
+	}
+	b.idx = (b.idx + 1) % len(b.conns)
+
+	if conn == nil {
+		return nil, balancers.ErrNoConn
+	}
+	return conn, nil
+}
+
+// Connections returns a list of all connections.
+func (b *Balancer) Connections() []balancers.Connection {
+	b.Lock()
+	defer b.Unlock()
+	conns := make([]balancers.Connection, len(b.conns))
+	copy(conns, b.conns)
+	return conns
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package leastconn
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/internal/balancertest"
+)
+
+func TestBalancerErrNoConnWithoutConnections(t *testing.T) {
+	balancer, err := NewBalancer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = balancer.Get()
+	if err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerPicksLeastInflight(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	a.Pending = 3
+	b := balancertest.NewConn("http://b")
+	b.Pending = 1
+	c := balancertest.NewConn("http://c")
+	c.Pending = 2
+
+	balancer, err := NewBalancer(a, b, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := balancer.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != b {
+		t.Errorf("expected %q; got: %q", b.URL(), conn.URL())
+	}
+
+	b.Broken = true
+	conn, err = balancer.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != c {
+		t.Errorf("expected %q; got: %q", c.URL(), conn.URL())
+	}
+}
+
+func TestBalancerBreaksTiesRoundRobin(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+
+	balancer, err := NewBalancer(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*balancertest.Conn{a, b, a, b}
+	for i, want := range expected {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != want {
+			t.Errorf("expected pick %d to be %q; got: %q", i, want.URL(), conn.URL())
+		}
+	}
+}
+
+func TestBalancerTracksInflightThroughTransport(t *testing.T) {
+	release := make(chan bool)
+	var visited []int
+
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		visited = append(visited, 1)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server1.Close()
+
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" {
+			visited = append(visited, 2)
+		}
+	}))
+	defer server2.Close()
+
+	url1, _ := url.Parse(server1.URL)
+	url2, _ := url.Parse(server2.URL)
+	conn1 := balancers.NewHttpConnection(url1, http.DefaultClient, 30*time.Second, 5*time.Minute)
+	conn2 := balancers.NewHttpConnection(url2, http.DefaultClient, 30*time.Second, 5*time.Minute)
+	defer conn1.Close()
+	defer conn2.Close()
+
+	balancer, err := NewBalancer(conn1, conn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := balancers.NewClient(balancer)
+
+	// The first request stays in flight until its body is read.
+	res, err := client.Get(server1.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := conn1.Inflight(); n != 1 {
+		t.Fatalf("expected %d request in flight; got: %d", 1, n)
+	}
+
+	// Subsequent requests must avoid the busy connection.
+	for i := 0; i < 2; i++ {
+		res2, err := client.Get(server1.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res2.Body)
+		res2.Body.Close()
+	}
+
+	close(release)
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if n := conn1.Inflight(); n != 0 {
+		t.Fatalf("expected %d requests in flight; got: %d", 0, n)
+	}
+	if n := conn2.Inflight(); n != 0 {
+		t.Fatalf("expected %d requests in flight; got: %d", 0, n)
+	}
+
+	expected := []int{1, 2, 2}
+	if len(visited) != len(expected) {
+		t.Fatalf("expected %d URLs to be visited; got: %d", len(expected), len(visited))
+	}
+	for i := range expected {
+		if visited[i] != expected[i] {
+			t.Errorf("expected request %d to visit server %d; got: %d", i, expected[i], visited[i])
+		}
+	}
+}
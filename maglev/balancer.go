@@ -0,0 +1,361 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+// Package maglev implements a consistent-hash balancer based on Maglev
+// hashing, as described in "Maglev: A Fast and Reliable Software Network
+// Load Balancer" (Eisenbud et al., NSDI 2016).
+//
+// Maglev precomputes a lookup table that maps hashed keys to connections,
+// so picking a connection takes constant time regardless of the number
+// of connections. The table is rebuilt when connections are added or
+// removed, or when the health of connections changes. Degraded connections
+// are only part of the table if no healthy connection is left.
+package maglev
+
+import (
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tianlin/balancers"
+)
+
+// BalancerOptions 包含负载均衡器的配置选项
+type BalancerOptions struct {
+	key             balancers.KeyFunc
+	tableSize       int
+	refreshInterval time.Duration
+}
+
+// Option 定义配置选项的函数类型
+type Option func(*BalancerOptions)
+
+// WithKey sets the function that extracts the key from a request.
+// The default is balancers.PathKey.
+func WithKey(key balancers.KeyFunc) Option {
+	return func(o *BalancerOptions) {
+		o.key = key
+	}
+}
+
+// WithTableSize sets the size of the lookup table. It must be a prime
+// number that is much larger than the number of connections; the paper
+// suggests at least 100 times the number of connections. The default
+// is 65537.
+func WithTableSize(size int) Option {
+	return func(o *BalancerOptions) {
+		o.tableSize = size
+	}
+}
+
+// WithRefreshInterval sets how often the balancer checks whether broken
+// connections have recovered. Connections that become broken are noticed
+// immediately when they are picked. The default is 1 second.
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(o *BalancerOptions) {
+		o.refreshInterval = interval
+	}
+}
+
+// 默认选项
+var defaultOptions = BalancerOptions{
+	key:             balancers.PathKey,
+	tableSize:       65537,
+	refreshInterval: time.Second,
+}
+
+// table is an immutable lookup table.
+type table struct {
+	conns   []balancers.Connection
+	health  []balancers.Health // health of conns when the table was built
+	entries []int32            // index into conns, empty if all conns are broken
+	checked time.Time
+}
+
+// Balancer implements a Maglev hashing balancer.
+type Balancer struct {
+	mu              sync.Mutex // serializes rebuilds
+	table           atomic.Pointer[table]
+	key             balancers.KeyFunc
+	size            int
+	refreshInterval time.Duration
+	now             func() time.Time
+}
+
+// NewBalancer creates a new Maglev hashing balancer. It can be
+// initialized by a variable number of connections. To change the
+// defaults, use NewBalancerWithOptions.
+func NewBalancer(conns ...balancers.Connection) (balancers.Balancer, error) {
+	b, err := NewBalancerWithOptions(conns)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewBalancerWithOptions creates a new Maglev hashing balancer for the
+// given connections, configured by opts.
+func NewBalancerWithOptions(conns []balancers.Connection, opts ...Option) (*Balancer, error) {
+	options := defaultOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.key == nil {
+		return nil, errors.New("key func must not be nil")
+	}
+	if !isPrime(options.tableSize) {
+		return nil, errors.New("table size must be a prime number")
+	}
+	if options.refreshInterval <= 0 {
+		return nil, errors.New("refresh interval must be greater than 0")
+	}
+
+	b := &Balancer{
+		key:             options.key,
+		size:            options.tableSize,
+		refreshInterval: options.refreshInterval,
+		now:             time.Now,
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.build(append([]balancers.Connection(nil), conns...))
+	return b, nil
+}
+
+// Add adds connections to the balancer.
+func (b *Balancer) Add(conns ...balancers.Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.table.Load()
+	b.build(append(append([]balancers.Connection(nil), t.conns...), conns...))
+}
+
+// Remove removes connections from the balancer.
+func (b *Balancer) Remove(conns ...balancers.Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.table.Load()
+	kept := make([]balancers.Connection, 0, len(t.conns))
+	for _, c := range t.conns {
+		removed := false
+		for _, r := range conns {
+			if c == r {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, c)
+		}
+	}
+	b.build(kept)
+}
+
+// Get returns the connection for an empty key.
+// ErrNoConn is returned when no connection is available.
+func (b *Balancer) Get() (balancers.Connection, error) {
+	return b.lookup("")
+}
+
+// GetForRequest returns the connection for the key of r.
+// ErrNoConn is returned when no connection is available.
+func (b *Balancer) GetForRequest(r *http.Request) (balancers.Connection, error) {
+	return b.lookup(b.key(r))
+}
+
+// GetExcluding returns the connection for the key of r like
+// GetForRequest, but skips the connections in exclude: it walks the
+// table from the slot of the key, so the remaining connections are
+// tried in an order that depends on the key. It implements
+// balancers.ExcludingBalancer.
+func (b *Balancer) GetExcluding(r *http.Request, exclude map[balancers.Connection]bool) (balancers.Connection, error) {
+	key := b.key(r)
+	conn, err := b.lookup(key)
+	if err != nil || !exclude[conn] {
+		return conn, err
+	}
+
+	// Only walk the table if it contains a connection to walk to.
+	t := b.table.Load()
+	if len(t.entries) == 0 {
+		return nil, balancers.ErrNoConn
+	}
+	use := t.health[t.entries[0]] // health of the connections in the table
+	var inTable bool
+	var fallback balancers.Connection
+	for _, c := range t.conns {
+		if exclude[c] {
+			continue
+		}
+		h := balancers.HealthOf(c)
+		if h == balancers.Unhealthy {
+			continue
+		}
+		if h == use {
+			inTable = true
+		}
+		if fallback == nil || h < balancers.HealthOf(fallback) {
+			fallback = c
+		}
+	}
+	if inTable {
+		start := hash(key, 0) % uint64(len(t.entries))
+		for i := uint64(1); i < uint64(len(t.entries)); i++ {
+			c := t.conns[t.entries[(start+i)%uint64(len(t.entries))]]
+			if !exclude[c] && !c.IsBroken() {
+				return c, nil
+			}
+		}
+	}
+	if fallback == nil {
+		return nil, balancers.ErrNoConn
+	}
+	return fallback, nil
+}
+
+func (b *Balancer) lookup(key string) (balancers.Connection, error) {
+	t := b.table.Load()
+	if b.now().Sub(t.checked) >= b.refreshInterval {
+		t = b.refresh(nil)
+	}
+	if len(t.entries) == 0 {
+		return nil, balancers.ErrNoConn
+	}
+
+	h := hash(key, 0) % uint64(len(t.entries))
+	conn := t.conns[t.entries[h]]
+	if balancers.HealthOf(conn) != t.health[t.entries[h]] {
+		t = b.refresh(t)
+		if len(t.entries) == 0 {
+			return nil, balancers.ErrNoConn
+		}
+		conn = t.conns[t.entries[h]]
+	}
+	return conn, nil
+}
+
+// refresh rebuilds the table if the health of its connections has
+// changed. If stale is not nil, the table is rebuilt unless another
+// goroutine has already replaced stale.
+func (b *Balancer) refresh(stale *table) *table {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.table.Load()
+	if stale != nil && t != stale {
+		return t
+	}
+	now := b.now()
+	if stale == nil && now.Sub(t.checked) < b.refreshInterval {
+		return t
+	}
+	for i, c := range t.conns {
+		if balancers.HealthOf(c) != t.health[i] {
+			return b.build(t.conns)
+		}
+	}
+	// Nothing changed: remember when we checked.
+	checked := *t
+	checked.checked = now
+	b.table.Store(&checked)
+	return &checked
+}
+
+// build creates and stores a new table for conns. b.mu must be locked.
+func (b *Balancer) build(conns []balancers.Connection) *table {
+	t := &table{
+		conns:   conns,
+		health:  make([]balancers.Health, len(conns)),
+		checked: b.now(),
+	}
+
+	// Compute the permutation of every connection in use as an offset and
+	// a skip, which only depend on the URL of the connection.
+	var healthy []int
+	var offset, skip, next []uint64
+	m := uint64(b.size)
+	use := balancers.Degraded
+	for i, c := range conns {
+		t.health[i] = balancers.HealthOf(c)
+		if t.health[i] == balancers.Healthy {
+			use = balancers.Healthy
+		}
+	}
+	for i, c := range conns {
+		if t.health[i] != use {
+			continue
+		}
+		id := c.URL().String()
+		healthy = append(healthy, i)
+		offset = append(offset, hash(id, 1)%m)
+		skip = append(skip, hash(id, 2)%(m-1)+1)
+		next = append(next, 0)
+	}
+
+	if len(healthy) > 0 {
+		t.entries = make([]int32, b.size)
+		for i := range t.entries {
+			t.entries[i] = -1
+		}
+		// Let the connections take turns in claiming their next preferred
+		// slot until the table is full.
+		for filled := 0; ; {
+			for i, idx := range healthy {
+				slot := (offset[i] + next[i]*skip[i]) % m
+				for t.entries[slot] >= 0 {
+					next[i]++
+					slot = (offset[i] + next[i]*skip[i]) % m
+				}
+				t.entries[slot] = int32(idx)
+				next[i]++
+				filled++
+				if filled == b.size {
+					b.table.Store(t)
+					return t
+				}
+			}
+		}
+	}
+	b.table.Store(t)
+	return t
+}
+
+// hash returns a 64-bit hash of s, salted with seed.
+func hash(s string, seed byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte{seed})
+	h.Write([]byte(s))
+	x := h.Sum64()
+	// Finalizer of splitmix64 to improve the distribution of FNV.
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// isPrime returns true if n is a prime number.
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for i := 2; i*i <= n; i++ {
+		if n%i == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Connections returns a list of all connections.
+func (b *Balancer) Connections() []balancers.Connection {
+	t := b.table.Load()
+	conns := make([]balancers.Connection, len(t.conns))
+	copy(conns, t.conns)
+	return conns
+}
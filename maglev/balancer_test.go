@@ -0,0 +1,247 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package maglev
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/consistenthash"
+	"github.com/tianlin/balancers/internal/balancertest"
+)
+
+func newRequest(path string) *http.Request {
+	r, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+	return r
+}
+
+// assign returns the connection for 3000 different paths.
+func assign(t *testing.T, b *Balancer) map[string]balancers.Connection {
+	m := make(map[string]balancers.Connection)
+	for i := 0; i < 3000; i++ {
+		path := fmt.Sprintf("/path/%d", i)
+		conn, err := b.GetForRequest(newRequest(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[path] = conn
+	}
+	return m
+}
+
+func TestNewBalancerValidatesTableSize(t *testing.T) {
+	if _, err := NewBalancerWithOptions(nil, WithTableSize(1000)); err == nil {
+		t.Error("expected error for table size that is not a prime number")
+	}
+	if _, err := NewBalancerWithOptions(nil, WithTableSize(1009)); err != nil {
+		t.Errorf("expected no error; got: %v", err)
+	}
+}
+
+func TestBalancerErrNoConnWithoutConnections(t *testing.T) {
+	balancer, err := NewBalancerWithOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = balancer.GetForRequest(newRequest("/"))
+	if err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerIsConsistentAndEven(t *testing.T) {
+	conns := []balancers.Connection{
+		balancertest.NewConn("http://a"),
+		balancertest.NewConn("http://b"),
+		balancertest.NewConn("http://c"),
+	}
+	b1, _ := NewBalancerWithOptions(conns)
+	b2, _ := NewBalancerWithOptions(conns)
+
+	m1 := assign(t, b1)
+	m2 := assign(t, b2)
+	counts := make(map[balancers.Connection]int)
+	for path, conn := range m1 {
+		if m2[path] != conn {
+			t.Fatalf("expected %q to map to %q; got: %q", path, conn.URL(), m2[path].URL())
+		}
+		counts[conn]++
+	}
+	for _, c := range conns {
+		if counts[c] < 900 || counts[c] > 1100 {
+			t.Errorf("expected %q to receive about 1000 keys; got: %d", c.URL(), counts[c])
+		}
+	}
+}
+
+func TestBalancerRebuildsWhenConnectionBreaksAndRecovers(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	c := balancertest.NewConn("http://c")
+	balancer, err := NewBalancerWithOptions([]balancers.Connection{a, b, c}, WithRefreshInterval(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	balancer.now = func() time.Time { return now }
+
+	before := assign(t, balancer)
+	b.Broken = true
+	after := assign(t, balancer)
+
+	moved := 0
+	for path, conn := range before {
+		if after[path] == b {
+			t.Fatalf("expected %q to move away from broken connection", path)
+		}
+		if conn != b && after[path] != conn {
+			moved++
+		}
+	}
+	// Maglev trades a little stability for even balance.
+	if moved > 150 {
+		t.Errorf("expected few keys of healthy connections to move; got: %d", moved)
+	}
+
+	// Recovery is noticed after the refresh interval.
+	b.Broken = false
+	if conns := assign(t, balancer); conns["/path/0"] != after["/path/0"] {
+		t.Errorf("expected table to be unchanged before refresh")
+	}
+	now = now.Add(time.Minute)
+	recovered := assign(t, balancer)
+	for path, conn := range before {
+		if recovered[path] != conn {
+			t.Fatalf("expected %q to move back to %q; got: %q", path, conn.URL(), recovered[path].URL())
+		}
+	}
+
+	a.Broken, b.Broken, c.Broken = true, true, true
+	if _, err := balancer.GetForRequest(newRequest("/path/0")); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerAddAndRemove(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	c := balancertest.NewConn("http://c")
+	balancer, _ := NewBalancerWithOptions([]balancers.Connection{a, b})
+
+	before := assign(t, balancer)
+	balancer.Add(c)
+	if n := len(balancer.Connections()); n != 3 {
+		t.Fatalf("expected %d connections; got: %d", 3, n)
+	}
+	after := assign(t, balancer)
+	moved := 0
+	for path, conn := range before {
+		if after[path] != conn {
+			moved++
+		}
+	}
+	if moved < 800 || moved > 1300 {
+		t.Errorf("expected about a third of the keys to move; got: %d", moved)
+	}
+
+	balancer.Remove(c)
+	removed := assign(t, balancer)
+	for path, conn := range before {
+		if removed[path] != conn {
+			t.Fatalf("expected %q to move back to %q; got: %q", path, conn.URL(), removed[path].URL())
+		}
+	}
+}
+
+func benchmarkConns(n int) []balancers.Connection {
+	conns := make([]balancers.Connection, n)
+	for i := range conns {
+		conns[i] = balancertest.NewConn(fmt.Sprintf("http://10.0.%d.%d:9200", i/256, i%256))
+	}
+	return conns
+}
+
+func benchmarkRequests() []*http.Request {
+	reqs := make([]*http.Request, 1024)
+	for i := range reqs {
+		reqs[i] = newRequest(fmt.Sprintf("/path/%d", i))
+	}
+	return reqs
+}
+
+func BenchmarkMaglev(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("conns=%d", n), func(b *testing.B) {
+			balancer, err := NewBalancerWithOptions(benchmarkConns(n), WithTableSize(100003))
+			if err != nil {
+				b.Fatal(err)
+			}
+			reqs := benchmarkRequests()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				balancer.GetForRequest(reqs[i%len(reqs)])
+			}
+		})
+	}
+}
+
+func BenchmarkConsistentHash(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("conns=%d", n), func(b *testing.B) {
+			balancer, err := consistenthash.NewBalancerWithOptions(benchmarkConns(n))
+			if err != nil {
+				b.Fatal(err)
+			}
+			reqs := benchmarkRequests()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				balancer.GetForRequest(reqs[i%len(reqs)])
+			}
+		})
+	}
+}
+
+func TestBalancerGetExcluding(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	c := balancertest.NewConn("http://c")
+	balancer, err := NewBalancerWithOptions([]balancers.Connection{a, b, c})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved := make(map[balancers.Connection]int)
+	for path, conn := range assign(t, balancer) {
+		exclude := map[balancers.Connection]bool{conn: true}
+		next, err := balancer.GetExcluding(newRequest(path), exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next == conn {
+			t.Fatalf("expected %q to move away from excluded connection", path)
+		}
+		again, _ := balancer.GetExcluding(newRequest(path), exclude)
+		if again != next {
+			t.Errorf("expected %q to move deterministically", path)
+		}
+		moved[next]++
+	}
+	if len(moved) != 3 {
+		t.Errorf("expected excluded keys to spread over all connections; got: %v", moved)
+	}
+
+	// The last connection is found even if it is not in the table.
+	a.State = balancers.Degraded
+	exclude := map[balancers.Connection]bool{b: true, c: true}
+	if conn, err := balancer.GetExcluding(newRequest("/"), exclude); err != nil || conn != a {
+		t.Errorf("expected %q; got: %v, %v", a.URL(), conn, err)
+	}
+	exclude[a] = true
+	if _, err := balancer.GetExcluding(newRequest("/"), exclude); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
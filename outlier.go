@@ -0,0 +1,280 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutcomeReporter is implemented by connections that learn from the
+// outcome of real requests. Transport calls ReportOutcome after each
+// request it sent to the connection, with the error returned by the
+// underlying RoundTripper or the status code of the response.
+type OutcomeReporter interface {
+	// ReportOutcome is called when the response headers of a request to
+	// the connection have been received (err is nil), or when the request
+	// failed (statusCode is 0).
+	ReportOutcome(statusCode int, err error)
+}
+
+// IsFailure reports whether the outcome of a request counts as a failure
+// for outlier detection: transport errors, including timeouts, and
+// responses with a 5xx status code.
+func IsFailure(statusCode int, err error) bool {
+	return err != nil || statusCode >= http.StatusInternalServerError
+}
+
+// OutlierDetector ejects connections based on the outcome of real
+// requests, i.e. it implements passive health checking. It is shared by
+// all connections of a pool; use WithOutlierDetector to add a connection.
+//
+// A connection is ejected after a number of consecutive failures, or
+// when its failure rate within a sliding window exceeds a threshold.
+// Ejected connections are reported as broken until the ejection time
+// is over. The ejection time grows with every ejection of the same
+// connection, and shrinks again while the connection is not ejected.
+// To never eject the whole pool, at most a percentage of the
+// connections are ejected at the same time.
+type OutlierDetector struct {
+	mu                  sync.Mutex // guards the following variables
+	hosts               map[*outlierHost]bool
+	consecutiveFailures int
+	failureRate         float64
+	minRequests         int
+	window              time.Duration
+	baseEjectionTime    time.Duration
+	maxEjectionTime     time.Duration
+	maxEjectionPercent  int
+	now                 func() time.Time
+}
+
+// OutlierOption configures an OutlierDetector.
+type OutlierOption func(*OutlierDetector)
+
+// WithConsecutiveFailures ejects a connection after n failures in a row.
+// It is 5 by default. Use 0 to disable.
+func WithConsecutiveFailures(n int) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.consecutiveFailures = n
+	}
+}
+
+// WithFailureRate ejects a connection when the ratio of failed requests
+// within the sliding window is rate or more, e.g. 0.5 for 50%. The rate
+// is only considered after at least minRequests requests in the window.
+// It is disabled by default.
+func WithFailureRate(rate float64, minRequests int) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.failureRate = rate
+		d.minRequests = minRequests
+	}
+}
+
+// WithFailureWindow sets the length of the sliding window of the failure
+// rate. It is 10 seconds by default.
+func WithFailureWindow(window time.Duration) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.window = window
+	}
+}
+
+// WithEjectionTime sets the time a connection is ejected for. The n-th
+// ejection of the same connection lasts n times base, but never longer
+// than max. For every base the connection is not ejected, n is lowered
+// by one, so a connection that has been fine for a while is ejected for
+// a short time again. By default, base is 30 seconds and max is 5
+// minutes.
+func WithEjectionTime(base, max time.Duration) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.baseEjectionTime = base
+		d.maxEjectionTime = max
+	}
+}
+
+// WithMaxEjectionPercent sets the maximum percentage of connections that
+// are ejected at the same time. It is 10 by default. Regardless of the
+// value, one connection can always be ejected if the pool has more than
+// one, and at least one connection is never ejected.
+func WithMaxEjectionPercent(percent int) OutlierOption {
+	return func(d *OutlierDetector) {
+		d.maxEjectionPercent = percent
+	}
+}
+
+// NewOutlierDetector creates a new outlier detector.
+func NewOutlierDetector(opts ...OutlierOption) *OutlierDetector {
+	d := &OutlierDetector{
+		hosts:               make(map[*outlierHost]bool),
+		consecutiveFailures: 5,
+		window:              10 * time.Second,
+		baseEjectionTime:    30 * time.Second,
+		maxEjectionTime:     5 * time.Minute,
+		maxEjectionPercent:  10,
+		now:                 time.Now,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// outlierBuckets is the number of buckets of the sliding window.
+const outlierBuckets = 10
+
+// outlierHost is the state of a single connection in an OutlierDetector.
+type outlierHost struct {
+	ejectedUntil atomic.Int64 // in Unix nanoseconds; read without lock
+
+	// The following variables are guarded by the detector.
+	consecutive int
+	ejections   int // multiplier of the ejection time
+	buckets     [outlierBuckets]outlierBucket
+}
+
+// outlierBucket counts requests within a slice of the sliding window.
+type outlierBucket struct {
+	epoch    int64 // index of the slice since the Unix epoch
+	requests int
+	failures int
+}
+
+// add registers a new connection with the detector.
+func (d *OutlierDetector) add() *outlierHost {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h := new(outlierHost)
+	d.hosts[h] = true
+	return h
+}
+
+// remove unregisters a connection from the detector.
+func (d *OutlierDetector) remove(h *outlierHost) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.hosts, h)
+}
+
+// ejected returns true if h is currently ejected.
+func (d *OutlierDetector) ejected(h *outlierHost) bool {
+	return d.now().UnixNano() < h.ejectedUntil.Load()
+}
+
+// report records the outcome of a request to h and ejects h if needed.
+// If h has been ejected, it returns the reason; otherwise it returns nil.
+func (d *OutlierDetector) report(h *outlierHost, statusCode int, err error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	failed := IsFailure(statusCode, err)
+	b := d.bucket(h, now)
+	b.requests++
+	if !failed {
+		h.consecutive = 0
+		return nil
+	}
+	b.failures++
+	h.consecutive++
+
+	var reason error
+	if d.consecutiveFailures > 0 && h.consecutive >= d.consecutiveFailures {
+		reason = fmt.Errorf("%d consecutive failures", h.consecutive)
+	} else if d.failureRate > 0 {
+		requests, failures := d.count(h, now)
+		if requests >= d.minRequests && float64(failures) >= d.failureRate*float64(requests) {
+			reason = fmt.Errorf("%d of %d requests failed", failures, requests)
+		}
+	}
+	if reason == nil || now.UnixNano() < h.ejectedUntil.Load() || !d.canEject(now) {
+		return nil
+	}
+
+	// Lower the multiplier for every base ejection time that h has not
+	// been ejected since its last ejection.
+	if h.ejections > 0 && d.baseEjectionTime > 0 {
+		healthy := time.Duration(now.UnixNano() - h.ejectedUntil.Load())
+		h.ejections -= int(healthy / d.baseEjectionTime)
+		if h.ejections < 0 {
+			h.ejections = 0
+		}
+	}
+	h.ejections++
+	ejection := d.baseEjectionTime * time.Duration(h.ejections)
+	if d.maxEjectionTime > 0 && ejection > d.maxEjectionTime {
+		ejection = d.maxEjectionTime
+	}
+	h.ejectedUntil.Store(now.Add(ejection).UnixNano())
+	// Start from scratch when the connection comes back.
+	h.consecutive = 0
+	h.buckets = [outlierBuckets]outlierBucket{}
+	return fmt.Errorf("%v, ejected for %v", reason, ejection)
+}
+
+// bucket returns the bucket of h for the given time, resetting it if
+// it belongs to an earlier slice of the window.
+func (d *OutlierDetector) bucket(h *outlierHost, now time.Time) *outlierBucket {
+	epoch := d.epoch(now)
+	b := &h.buckets[epoch%outlierBuckets]
+	if b.epoch != epoch {
+		*b = outlierBucket{epoch: epoch}
+	}
+	return b
+}
+
+// count returns the number of requests and failures of h within the
+// sliding window.
+func (d *OutlierDetector) count(h *outlierHost, now time.Time) (requests, failures int) {
+	epoch := d.epoch(now)
+	for _, b := range h.buckets {
+		if epoch-b.epoch < outlierBuckets {
+			requests += b.requests
+			failures += b.failures
+		}
+	}
+	return
+}
+
+// epoch returns the index of the slice of the window that now is in.
+func (d *OutlierDetector) epoch(now time.Time) int64 {
+	width := int64(d.window / outlierBuckets)
+	if width <= 0 {
+		width = 1
+	}
+	return now.UnixNano() / width
+}
+
+// canEject returns true if another connection may be ejected without
+// exceeding the maximum ejection percentage.
+func (d *OutlierDetector) canEject(now time.Time) bool {
+	n := len(d.hosts)
+	max := n * d.maxEjectionPercent / 100
+	if max < 1 {
+		max = 1
+	}
+	if max > n-1 {
+		max = n - 1
+	}
+	ejected := 0
+	for h := range d.hosts {
+		if now.UnixNano() < h.ejectedUntil.Load() {
+			ejected++
+		}
+	}
+	return ejected < max
+}
+
+// WithOutlierDetector adds the connection to the given outlier detector.
+// Transport reports the outcome of each request to the connection, and
+// the connection is reported as broken while it is ejected. Share the
+// detector between all connections of a balancer.
+func WithOutlierDetector(d *OutlierDetector) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.outliers = d
+		c.outlierHost = d.add()
+	}
+}
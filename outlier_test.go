@@ -0,0 +1,217 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetectorConsecutiveFailures(t *testing.T) {
+	now := time.Now()
+	d := NewOutlierDetector(WithConsecutiveFailures(3), WithMaxEjectionPercent(50))
+	d.now = func() time.Time { return now }
+	a := newHealthyConn(t, "http://127.0.0.1:9200", WithOutlierDetector(d))
+	newHealthyConn(t, "http://127.0.0.1:9201", WithOutlierDetector(d))
+
+	a.ReportOutcome(500, nil)
+	a.ReportOutcome(0, errors.New("connection refused"))
+	a.ReportOutcome(200, nil) // resets the consecutive failures
+	a.ReportOutcome(502, nil)
+	a.ReportOutcome(503, nil)
+	if a.IsBroken() {
+		t.Fatal("expected connection to not be ejected")
+	}
+	a.ReportOutcome(0, context.DeadlineExceeded)
+	if !a.IsBroken() || !a.IsEjected() {
+		t.Fatal("expected connection to be ejected")
+	}
+
+	// The first ejection lasts 30 seconds.
+	now = now.Add(29 * time.Second)
+	if !a.IsBroken() {
+		t.Fatal("expected connection to still be ejected")
+	}
+	now = now.Add(time.Second)
+	if a.IsBroken() {
+		t.Fatal("expected connection to be back")
+	}
+
+	// The second ejection lasts twice as long.
+	for i := 0; i < 3; i++ {
+		a.ReportOutcome(500, nil)
+	}
+	now = now.Add(59 * time.Second)
+	if !a.IsBroken() {
+		t.Fatal("expected connection to be ejected for 60 seconds")
+	}
+	now = now.Add(time.Second)
+	if a.IsBroken() {
+		t.Fatal("expected connection to be back")
+	}
+}
+
+func TestOutlierDetectorEjectionTimeRecovers(t *testing.T) {
+	now := time.Now()
+	d := NewOutlierDetector(WithConsecutiveFailures(1), WithMaxEjectionPercent(50))
+	d.now = func() time.Time { return now }
+	a := newHealthyConn(t, "http://127.0.0.1:9200", WithOutlierDetector(d))
+	newHealthyConn(t, "http://127.0.0.1:9201", WithOutlierDetector(d))
+
+	// Eject three times in a row: 30s, 60s, 90s.
+	for _, ejection := range []time.Duration{30 * time.Second, 60 * time.Second, 90 * time.Second} {
+		a.ReportOutcome(500, nil)
+		now = now.Add(ejection - time.Second)
+		if !a.IsEjected() {
+			t.Fatalf("expected connection to be ejected for %v", ejection)
+		}
+		now = now.Add(time.Second)
+		if a.IsEjected() {
+			t.Fatalf("expected connection to be back after %v", ejection)
+		}
+	}
+
+	// After two base ejection times without ejection, the multiplier is
+	// lowered by two, so the next ejection is one step shorter.
+	now = now.Add(60 * time.Second)
+	a.ReportOutcome(500, nil)
+	now = now.Add(59 * time.Second)
+	if !a.IsEjected() {
+		t.Fatal("expected connection to be ejected for 60 seconds")
+	}
+	now = now.Add(time.Second)
+	if a.IsEjected() {
+		t.Fatal("expected ejection time to be lowered after a healthy period")
+	}
+
+	// After a long healthy period, the ejection time is back to the base.
+	now = now.Add(time.Hour)
+	a.ReportOutcome(500, nil)
+	now = now.Add(30 * time.Second)
+	if a.IsEjected() {
+		t.Fatal("expected ejection time to be back to 30 seconds")
+	}
+}
+
+func TestOutlierDetectorFailureRate(t *testing.T) {
+	now := time.Now()
+	d := NewOutlierDetector(
+		WithConsecutiveFailures(0),
+		WithFailureRate(0.5, 10),
+		WithFailureWindow(10*time.Second),
+		WithMaxEjectionPercent(50),
+	)
+	d.now = func() time.Time { return now }
+	a := newHealthyConn(t, "http://127.0.0.1:9200", WithOutlierDetector(d))
+	newHealthyConn(t, "http://127.0.0.1:9201", WithOutlierDetector(d))
+
+	// Failures that slid out of the window do not count.
+	for i := 0; i < 5; i++ {
+		a.ReportOutcome(500, nil)
+	}
+	now = now.Add(11 * time.Second)
+	for i := 0; i < 8; i++ {
+		a.ReportOutcome(200, nil)
+		a.ReportOutcome(200, nil)
+		a.ReportOutcome(500, nil)
+	}
+	if a.IsBroken() {
+		t.Fatal("expected connection to not be ejected at a failure rate of 33%")
+	}
+	for i := 0; i < 8; i++ {
+		a.ReportOutcome(500, nil)
+	}
+	if !a.IsBroken() {
+		t.Fatal("expected connection to be ejected at a failure rate of 50%")
+	}
+}
+
+func TestOutlierDetectorMaxEjectionPercent(t *testing.T) {
+	d := NewOutlierDetector(WithConsecutiveFailures(1), WithMaxEjectionPercent(100))
+	conns := []*HttpConnection{
+		newHealthyConn(t, "http://127.0.0.1:9200", WithOutlierDetector(d)),
+		newHealthyConn(t, "http://127.0.0.1:9201", WithOutlierDetector(d)),
+		newHealthyConn(t, "http://127.0.0.1:9202", WithOutlierDetector(d)),
+	}
+	for _, c := range conns {
+		c.ReportOutcome(500, nil)
+	}
+	ejected := 0
+	for _, c := range conns {
+		if c.IsEjected() {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Errorf("expected 2 of 3 connections to be ejected; got: %d", ejected)
+	}
+
+	// With the default of 10%, still one connection can be ejected.
+	d = NewOutlierDetector(WithConsecutiveFailures(1))
+	a := newHealthyConn(t, "http://127.0.0.1:9200", WithOutlierDetector(d))
+	b := newHealthyConn(t, "http://127.0.0.1:9201", WithOutlierDetector(d))
+	a.ReportOutcome(500, nil)
+	b.ReportOutcome(500, nil)
+	if !a.IsEjected() || b.IsEjected() {
+		t.Errorf("expected only the first connection to be ejected; got: %v and %v", a.IsEjected(), b.IsEjected())
+	}
+}
+
+func TestTransportReportsOutcome(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	d := NewOutlierDetector(WithConsecutiveFailures(2))
+	a := newHealthyConn(t, server.URL, WithOutlierDetector(d))
+	newHealthyConn(t, "http://127.0.0.1:9201", WithOutlierDetector(d))
+	client := NewClient(&testBalancer{conn: a})
+
+	for i := 0; i < 2; i++ {
+		res, err := client.Get("http://localhost/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if !a.IsBroken() {
+		t.Error("expected connection to be ejected after two 502 responses")
+	}
+}
+
+func TestTransportDoesNotReportCanceledRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	d := NewOutlierDetector(WithConsecutiveFailures(1))
+	a := newHealthyConn(t, server.URL, WithOutlierDetector(d))
+	newHealthyConn(t, "http://127.0.0.1:9201", WithOutlierDetector(d))
+	client := NewClient(&testBalancer{conn: a})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://localhost/", nil)
+	if _, err := client.Do(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v; got: %v", context.Canceled, err)
+	}
+	if a.IsBroken() {
+		t.Error("expected connection not to be ejected after the caller canceled a request")
+	}
+
+	// Requests that time out are failures.
+	client.Timeout = 20 * time.Millisecond
+	if _, err := client.Get("http://localhost/"); err == nil {
+		t.Fatal("expected timeout")
+	}
+	if !a.IsBroken() {
+		t.Error("expected connection to be ejected after a request timed out")
+	}
+}
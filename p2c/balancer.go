@@ -0,0 +1,213 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+// Package p2c implements a power-of-two-choices balancer. It samples two
+// random connections and picks the one with the lower load, which is
+// almost as good as a full least-loaded scan but does not need to look
+// at every connection.
+//
+// By default, the load of a connection is its number of requests in
+// flight. WithLatencyEWMA takes the response latency into account, and
+// WithLoad allows for custom scores.
+package p2c
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/peakewma"
+)
+
+// maxSamples is the number of times Get samples two random connections
+// before falling back to a scan of all non-broken connections.
+const maxSamples = 3
+
+// LoadFunc returns the load of a connection. Lower is better.
+type LoadFunc func(balancers.Connection) float64
+
+// InflightLoad uses the number of requests in flight as the load of
+// a connection. See balancers.InflightTracker. It is the default, unless
+// WithLatencyEWMA is used.
+func InflightLoad(c balancers.Connection) float64 {
+	return float64(balancers.InflightOf(c))
+}
+
+// BalancerOptions 包含负载均衡器的配置选项
+type BalancerOptions struct {
+	load    LoadFunc
+	latency *peakewma.EWMA
+	source  rand.Source
+}
+
+// Option 定义配置选项的函数类型
+type Option func(*BalancerOptions)
+
+// WithLoad sets the function that computes the load of a connection.
+func WithLoad(load LoadFunc) Option {
+	return func(o *BalancerOptions) {
+		o.load = load
+	}
+}
+
+// WithLatencyEWMA feeds the response latencies that Transport reports to
+// the balancer into e. Unless WithLoad is used, e.Cost is the load of a
+// connection, i.e. the balancer picks the connection that is expected to
+// respond faster. A custom LoadFunc may combine e.Cost or e.Latency with
+// other metrics.
+func WithLatencyEWMA(e *peakewma.EWMA) Option {
+	return func(o *BalancerOptions) {
+		o.latency = e
+	}
+}
+
+// WithSource sets the source of randomness, e.g. to get deterministic
+// results in tests.
+func WithSource(source rand.Source) Option {
+	return func(o *BalancerOptions) {
+		o.source = source
+	}
+}
+
+// Balancer implements a power-of-two-choices balancer.
+type Balancer struct {
+	conns   []balancers.Connection
+	load    LoadFunc
+	latency *peakewma.EWMA // nil if latencies are ignored
+
+	mu  sync.Mutex // guards rnd
+	rnd *rand.Rand
+}
+
+// NewBalancer creates a new power-of-two-choices balancer. It can be
+// initialized by a variable number of connections. To change the
+// defaults, use NewBalancerWithOptions.
+func NewBalancer(conns ...balancers.Connection) (balancers.Balancer, error) {
+	b, err := NewBalancerWithOptions(conns)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewBalancerWithOptions creates a new power-of-two-choices balancer
+// for the given connections, configured by opts.
+func NewBalancerWithOptions(conns []balancers.Connection, opts ...Option) (*Balancer, error) {
+	var options BalancerOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.load == nil {
+		options.load = InflightLoad
+		if options.latency != nil {
+			options.load = options.latency.Cost
+		}
+	}
+	if options.source == nil {
+		options.source = rand.NewSource(time.Now().UnixNano())
+	}
+
+	b := &Balancer{
+		conns:   make([]balancers.Connection, len(conns)),
+		load:    options.load,
+		latency: options.latency,
+		rnd:     rand.New(options.source),
+	}
+	copy(b.conns, conns)
+	return b, nil
+}
+
+// Get samples two random non-broken connections and returns the one with
+// the lower load. ErrNoConn is returned when no connection is available.
+func (b *Balancer) Get() (balancers.Connection, error) {
+	for i := 0; i < maxSamples; i++ {
+		x, y, ok := b.sample(b.conns)
+		if !ok {
+			break
+		}
+		xok := balancers.HealthOf(x) == balancers.Healthy
+		yok := balancers.HealthOf(y) == balancers.Healthy
+		switch {
+		case xok && yok:
+			return b.pick(x, y), nil
+		case xok:
+			return x, nil
+		case yok:
+			return y, nil
+		}
+	}
+
+	// Too many broken or degraded connections: sample from the healthy
+	// ones, or from the degraded ones if no healthy connection is left.
+	healthy := make([]balancers.Connection, 0, len(b.conns))
+	var degraded []balancers.Connection
+	for _, c := range b.conns {
+		switch balancers.HealthOf(c) {
+		case balancers.Healthy:
+			healthy = append(healthy, c)
+		case balancers.Degraded:
+			degraded = append(degraded, c)
+		}
+	}
+	conns := healthy
+	if len(conns) == 0 {
+		conns = degraded
+	}
+	switch len(conns) {
+	case 0:
+		return nil, balancers.ErrNoConn
+	case 1:
+		return conns[0], nil
+	}
+	x, y, _ := b.sample(conns)
+	return b.pick(x, y), nil
+}
+
+// sample returns two distinct random connections from conns. It returns
+// the same connection twice if there is only one, and false if conns
+// is empty.
+func (b *Balancer) sample(conns []balancers.Connection) (balancers.Connection, balancers.Connection, bool) {
+	n := len(conns)
+	if n < 2 {
+		if n == 1 {
+			return conns[0], conns[0], true
+		}
+		return nil, nil, false
+	}
+	b.mu.Lock()
+	i := b.rnd.Intn(n)
+	j := b.rnd.Intn(n - 1)
+	b.mu.Unlock()
+	if j >= i {
+		j++
+	}
+	return conns[i], conns[j], true
+}
+
+// pick returns the connection with the lower load.
+func (b *Balancer) pick(x, y balancers.Connection) balancers.Connection {
+	if b.load(y) < b.load(x) {
+		return y
+	}
+	return x
+}
+
+// ObserveHeaders implements balancers.LatencyObserver. It feeds d into
+// the EWMA set with WithLatencyEWMA, if any.
+func (b *Balancer) ObserveHeaders(conn balancers.Connection, d time.Duration) {
+	if b.latency != nil {
+		b.latency.Observe(conn, d)
+	}
+}
+
+// ObserveBody implements balancers.LatencyObserver.
+func (b *Balancer) ObserveBody(conn balancers.Connection, d time.Duration) {}
+
+// Connections returns a list of all connections.
+func (b *Balancer) Connections() []balancers.Connection {
+	conns := make([]balancers.Connection, len(b.conns))
+	copy(conns, b.conns)
+	return conns
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package p2c
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/internal/balancertest"
+	"github.com/tianlin/balancers/peakewma"
+)
+
+func TestBalancerErrNoConnWithoutConnections(t *testing.T) {
+	balancer, err := NewBalancer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = balancer.Get()
+	if err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerNeverPicksMostLoaded(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	a.Pending = 1
+	b := balancertest.NewConn("http://b")
+	b.Pending = 2
+	c := balancertest.NewConn("http://c")
+	c.Pending = 10
+
+	balancer, err := NewBalancerWithOptions(
+		[]balancers.Connection{a, b, c},
+		WithSource(rand.NewSource(1)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[conn.URL().Host]++
+	}
+	if counts["c"] != 0 {
+		t.Errorf("expected most loaded connection to never be picked; got: %d", counts["c"])
+	}
+	if counts["a"] <= counts["b"] {
+		t.Errorf("expected least loaded connection to be picked most often; got: %v", counts)
+	}
+}
+
+func TestBalancerIsDeterministicWithSource(t *testing.T) {
+	conns := []balancers.Connection{
+		balancertest.NewConn("http://a"),
+		balancertest.NewConn("http://b"),
+		balancertest.NewConn("http://c"),
+		balancertest.NewConn("http://d"),
+	}
+	zero := func(balancers.Connection) float64 { return 0 }
+
+	b1, _ := NewBalancerWithOptions(conns, WithSource(rand.NewSource(42)), WithLoad(zero))
+	b2, _ := NewBalancerWithOptions(conns, WithSource(rand.NewSource(42)), WithLoad(zero))
+	for i := 0; i < 20; i++ {
+		c1, _ := b1.Get()
+		c2, _ := b2.Get()
+		if c1 != c2 {
+			t.Fatalf("expected pick %d to be equal; got: %q and %q", i, c1.URL(), c2.URL())
+		}
+	}
+}
+
+func TestBalancerSkipsBrokenConnections(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	b.Pending = 5
+	c := balancertest.NewConn("http://c")
+	d := balancertest.NewConn("http://d")
+	a.Broken = true
+	c.Broken = true
+	d.Broken = true
+
+	balancer, err := NewBalancerWithOptions(
+		[]balancers.Connection{a, b, c, d},
+		WithSource(rand.NewSource(1)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != b {
+			t.Fatalf("expected %q; got: %q", b.URL(), conn.URL())
+		}
+	}
+
+	b.Broken = true
+	_, err = balancer.Get()
+	if err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerWithLatencyEWMAPrefersFastConnections(t *testing.T) {
+	var slowRequests, fastRequests int
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowRequests++
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastRequests++
+	}))
+	defer fast.Close()
+
+	ewma, err := peakewma.NewEWMA(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer, err := NewBalancerWithOptions(
+		[]balancers.Connection{balancertest.NewConn(slow.URL), balancertest.NewConn(fast.URL)},
+		WithLatencyEWMA(ewma),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := balancers.NewClient(balancer)
+	for i := 0; i < 20; i++ {
+		res, err := client.Get("http://localhost/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	// Both connections are tried once, then the fast one wins.
+	if slowRequests != 1 || fastRequests != 19 {
+		t.Errorf("expected 1 request to the slow host and 19 to the fast one; got: %d and %d", slowRequests, fastRequests)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+// Package peakewma implements a latency-aware balancer. It keeps a
+// peak-sensitive exponentially weighted moving average (EWMA) of the
+// response latency of each connection and picks the connection with the
+// lowest expected cost, i.e. the average latency multiplied by the number
+// of requests in flight.
+//
+// The EWMA reacts to latency spikes immediately and only slowly decays
+// back, so traffic drifts away from degrading backends long before their
+// heartbeat fails.
+package peakewma
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tianlin/balancers"
+)
+
+// BalancerOptions 包含负载均衡器的配置选项
+type BalancerOptions struct {
+	decay       time.Duration
+	bodyLatency bool
+}
+
+// Option 定义配置选项的函数类型
+type Option func(*BalancerOptions)
+
+// WithDecay sets the time it takes for the EWMA to forget about past
+// measurements. Lower values react faster to changes in latency.
+// The default is 10 seconds.
+func WithDecay(decay time.Duration) Option {
+	return func(o *BalancerOptions) {
+		o.decay = decay
+	}
+}
+
+// WithBodyLatency feeds the time it takes to receive the complete
+// response into the EWMA. By default, the time to receive the response
+// headers is used.
+func WithBodyLatency() Option {
+	return func(o *BalancerOptions) {
+		o.bodyLatency = true
+	}
+}
+
+// 默认选项
+var defaultOptions = BalancerOptions{
+	decay: 10 * time.Second,
+}
+
+// Balancer implements a peak-EWMA balancer. It must be used with a client
+// created by balancers.NewClient, which reports latencies to it. The number
+// of requests in flight is taken from balancers.InflightTracker.
+type Balancer struct {
+	sync.Mutex  // guards the following variables
+	conns       []balancers.Connection
+	idx         int // index into conns where the next scan starts
+	ewma        *EWMA
+	bodyLatency bool
+}
+
+// NewBalancer creates a new peak-EWMA balancer. It can be initialized
+// by a variable number of connections. To change the defaults, use
+// NewBalancerWithOptions.
+func NewBalancer(conns ...balancers.Connection) (balancers.Balancer, error) {
+	b, err := NewBalancerWithOptions(conns)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewBalancerWithOptions creates a new peak-EWMA balancer for the given
+// connections, configured by opts.
+func NewBalancerWithOptions(conns []balancers.Connection, opts ...Option) (*Balancer, error) {
+	options := defaultOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	ewma, err := NewEWMA(options.decay)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Balancer{
+		conns:       make([]balancers.Connection, len(conns)),
+		ewma:        ewma,
+		bodyLatency: options.bodyLatency,
+	}
+	copy(b.conns, conns)
+	return b, nil
+}
+
+// Get returns the connection with the lowest expected cost.
+// ErrNoConn is returned when no connection is available.
+func (b *Balancer) Get() (balancers.Connection, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.conns) == 0 {
+		return nil, balancers.ErrNoConn
+	}
+
+	// Healthy connections always win over degraded ones.
+	var conn balancers.Connection
+	var health balancers.Health
+	min := 0.0
+	for i := 0; i < len(b.conns); i++ {
+		candidate := b.conns[(b.idx+i)%len(b.conns)]
+		h := balancers.HealthOf(candidate)
+		if h == balancers.Unhealthy {
+			continue
+		}
+		if cost := b.ewma.Cost(candidate); conn == nil || h < health || (h == health && cost < min) {
+			conn = candidate
+			health = h
+			min = cost
+		}
+	}
+	b.idx = (b.idx + 1) % len(b.conns)
+
+	if conn == nil {
+		return nil, balancers.ErrNoConn
+	}
+	return conn, nil
+}
+
+// Cost returns the current expected cost of the given connection.
+func (b *Balancer) Cost(conn balancers.Connection) float64 {
+	return b.ewma.Cost(conn)
+}
+
+// ObserveHeaders implements balancers.LatencyObserver.
+func (b *Balancer) ObserveHeaders(conn balancers.Connection, d time.Duration) {
+	if !b.bodyLatency {
+		b.observeLatency(conn, d)
+	}
+}
+
+// ObserveBody implements balancers.LatencyObserver.
+func (b *Balancer) ObserveBody(conn balancers.Connection, d time.Duration) {
+	if b.bodyLatency {
+		b.observeLatency(conn, d)
+	}
+}
+
+func (b *Balancer) observeLatency(conn balancers.Connection, d time.Duration) {
+	b.ewma.Observe(conn, d)
+}
+
+// Connections returns a list of all connections.
+func (b *Balancer) Connections() []balancers.Connection {
+	b.Lock()
+	defer b.Unlock()
+	conns := make([]balancers.Connection, len(b.conns))
+	copy(conns, b.conns)
+	return conns
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package peakewma
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/internal/balancertest"
+)
+
+// testClock is a manually advanced clock.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time          { return c.now }
+func (c *testClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestBalancer(t *testing.T, conns []balancers.Connection, opts ...Option) (*Balancer, *testClock) {
+	b, err := NewBalancerWithOptions(conns, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{now: time.Unix(1000, 0)}
+	b.ewma.now = clock.Now
+	return b, clock
+}
+
+func TestBalancerErrNoConnWithoutConnections(t *testing.T) {
+	balancer, _ := newTestBalancer(t, nil)
+	_, err := balancer.Get()
+	if err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerPicksLowestLatency(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	balancer, clock := newTestBalancer(t, []balancers.Connection{a, b})
+
+	balancer.ObserveHeaders(a, 100*time.Millisecond)
+	balancer.ObserveHeaders(b, 10*time.Millisecond)
+	clock.Advance(time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != b {
+			t.Errorf("expected %q; got: %q", b.URL(), conn.URL())
+		}
+	}
+
+	// Requests in flight increase the cost.
+	b.Pending = 20
+	conn, err := balancer.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != a {
+		t.Errorf("expected %q; got: %q", a.URL(), conn.URL())
+	}
+}
+
+func TestBalancerReactsToPeaksAndDecays(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	balancer, clock := newTestBalancer(t, []balancers.Connection{a}, WithDecay(time.Second))
+
+	balancer.ObserveHeaders(a, 10*time.Millisecond)
+	clock.Advance(10 * time.Millisecond)
+	balancer.ObserveHeaders(a, 500*time.Millisecond)
+	if cost := balancer.Cost(a); cost != float64(500*time.Millisecond) {
+		t.Errorf("expected cost to jump to peak %v; got: %v", float64(500*time.Millisecond), cost)
+	}
+
+	clock.Advance(time.Second)
+	balancer.ObserveHeaders(a, 10*time.Millisecond)
+	cost := balancer.Cost(a)
+	if cost >= float64(500*time.Millisecond) || cost <= float64(10*time.Millisecond) {
+		t.Errorf("expected cost to decay between %v and %v; got: %v",
+			float64(10*time.Millisecond), float64(500*time.Millisecond), cost)
+	}
+}
+
+func TestBalancerBodyLatency(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	balancer, _ := newTestBalancer(t, []balancers.Connection{a}, WithBodyLatency())
+
+	balancer.ObserveHeaders(a, 10*time.Millisecond)
+	if cost := balancer.Cost(a); cost != 0 {
+		t.Errorf("expected header latency to be ignored; got: %v", cost)
+	}
+	balancer.ObserveBody(a, 50*time.Millisecond)
+	if cost := balancer.Cost(a); cost != float64(50*time.Millisecond) {
+		t.Errorf("expected cost %v; got: %v", float64(50*time.Millisecond), cost)
+	}
+}
+
+func TestBalancerMeasuresLatencyThroughTransport(t *testing.T) {
+	var visited []int
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" {
+			visited = append(visited, 1)
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" {
+			visited = append(visited, 2)
+		}
+	}))
+	defer fast.Close()
+
+	url1, _ := url.Parse(slow.URL)
+	url2, _ := url.Parse(fast.URL)
+	conn1 := balancers.NewHttpConnection(url1, http.DefaultClient, 30*time.Second, 5*time.Minute)
+	conn2 := balancers.NewHttpConnection(url2, http.DefaultClient, 30*time.Second, 5*time.Minute)
+	defer conn1.Close()
+	defer conn2.Close()
+	balancer, err := NewBalancer(conn1, conn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := balancers.NewClient(balancer)
+	for i := 0; i < 5; i++ {
+		res, err := client.Get(slow.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	// Both are tried once, then only the fast one is used.
+	expected := []int{1, 2, 2, 2, 2}
+	if len(visited) != len(expected) {
+		t.Fatalf("expected %d URLs to be visited; got: %d", len(expected), len(visited))
+	}
+	for i := range expected {
+		if visited[i] != expected[i] {
+			t.Errorf("expected request %d to visit server %d; got: %d", i, expected[i], visited[i])
+		}
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	e, err := NewEWMA(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{now: time.Unix(1000, 0)}
+	e.now = clock.Now
+	a := balancertest.NewConn("http://a")
+
+	if got := e.Latency(a); got != 0 {
+		t.Fatalf("expected no latency before the first measurement; got: %v", got)
+	}
+	e.Observe(a, 100*time.Millisecond)
+	if got := e.Latency(a); got != 100*time.Millisecond {
+		t.Fatalf("expected first measurement; got: %v", got)
+	}
+
+	// After the decay time, the old average has a weight of 1/e.
+	clock.Advance(10 * time.Second)
+	want := time.Duration(float64(100*time.Millisecond) * math.Exp(-1))
+	if got := e.Latency(a); got < want-time.Microsecond || got > want+time.Microsecond {
+		t.Errorf("expected %v; got: %v", want, got)
+	}
+
+	// The cost grows with the number of requests in flight.
+	a.Pending = 1
+	if got, want := e.Cost(a), 2*float64(e.Latency(a)); got != want {
+		t.Errorf("expected cost %v; got: %v", want, got)
+	}
+	b := balancertest.NewConn("http://b")
+	b.Pending = 1
+	if e.Cost(b) <= e.Cost(a) {
+		t.Error("expected unmeasured connection with requests in flight to have a higher cost")
+	}
+
+	if _, err := NewEWMA(0); err == nil {
+		t.Error("expected error for decay of 0")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package peakewma
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tianlin/balancers"
+)
+
+// penalty is the cost of a connection without any latency measurements
+// that already has requests in flight.
+const penalty = float64(math.MaxInt64 >> 16)
+
+// EWMA keeps a peak-sensitive exponentially weighted moving average of
+// the response latency of every connection. It is used by Balancer, and
+// may be used by other balancers that take latencies into account, e.g.
+// the p2c balancer.
+type EWMA struct {
+	decay float64 // in nanoseconds
+	now   func() time.Time
+
+	mu    sync.Mutex // guards stats
+	stats map[balancers.Connection]*ewma
+}
+
+// ewma is the moving average of a single connection.
+type ewma struct {
+	cost  float64 // in nanoseconds
+	stamp time.Time
+}
+
+// NewEWMA creates a new EWMA. decay is the time it takes to forget about
+// past measurements; lower values react faster to changes in latency.
+func NewEWMA(decay time.Duration) (*EWMA, error) {
+	if decay <= 0 {
+		return nil, errors.New("decay must be greater than 0")
+	}
+	return &EWMA{
+		decay: float64(decay),
+		now:   time.Now,
+		stats: make(map[balancers.Connection]*ewma),
+	}, nil
+}
+
+// Latency returns the average latency of c, or 0 if it has not been
+// measured yet.
+func (e *EWMA) Latency(c balancers.Connection) time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s, found := e.stats[c]
+	if !found {
+		return 0
+	}
+	// Decay towards zero so that a connection that has not been used
+	// for a while gets another chance.
+	e.observe(s, e.now(), 0)
+	return time.Duration(s.cost)
+}
+
+// Cost returns the expected cost of c, i.e. its average latency multiplied
+// by the number of requests in flight plus one. Connections that have not
+// been measured yet cost nothing, so they are tried, unless they already
+// have requests in flight.
+func (e *EWMA) Cost(c balancers.Connection) float64 {
+	latency := float64(e.Latency(c))
+	pending := balancers.InflightOf(c)
+	if latency == 0 && pending != 0 {
+		return penalty + float64(pending)
+	}
+	return latency * float64(pending+1)
+}
+
+// Observe adds the latency d of a request to c.
+func (e *EWMA) Observe(c balancers.Connection, d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s, found := e.stats[c]
+	if !found {
+		s = &ewma{}
+		e.stats[c] = s
+	}
+	e.observe(s, e.now(), float64(d))
+}
+
+// observe adds the latency rtt to s. e must be locked.
+func (e *EWMA) observe(s *ewma, now time.Time, rtt float64) {
+	td := now.Sub(s.stamp)
+	if td < 0 {
+		td = 0
+	}
+	s.stamp = now
+	if rtt > s.cost {
+		// Peak sensitivity: react to spikes immediately.
+		s.cost = rtt
+		return
+	}
+	w := math.Exp(-float64(td) / e.decay)
+	s.cost = s.cost*w + rtt*(1-w)
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+// Package random implements a balancer that picks a connection at random.
+package random
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/tianlin/balancers"
+)
+
+// BalancerOptions 包含负载均衡器的配置选项
+type BalancerOptions struct {
+	client               *http.Client
+	initialRetryInterval time.Duration
+	maxRetryInterval     time.Duration
+	connectionOptions    []balancers.ConnectionOption
+	source               rand.Source
+}
+
+// Option 定义配置选项的函数类型
+type Option func(*BalancerOptions)
+
+// WithClient 设置 HTTP 客户端
+func WithClient(client *http.Client) Option {
+	return func(o *BalancerOptions) {
+		o.client = client
+	}
+}
+
+// WithInitialRetryInterval 设置初始重试间隔时间
+func WithInitialRetryInterval(interval time.Duration) Option {
+	return func(o *BalancerOptions) {
+		o.initialRetryInterval = interval
+	}
+}
+
+// WithMaxRetryInterval 设置最大重试间隔时间
+func WithMaxRetryInterval(interval time.Duration) Option {
+	return func(o *BalancerOptions) {
+		o.maxRetryInterval = interval
+	}
+}
+
+// WithSource 设置随机数来源，例如在测试中获得确定的结果，默认使用 math/rand 的顶层函数
+func WithSource(source rand.Source) Option {
+	return func(o *BalancerOptions) {
+		o.source = source
+	}
+}
+
+// WithConnectionOptions 设置创建 HTTP 连接时使用的选项，例如健康检查
+func WithConnectionOptions(opts ...balancers.ConnectionOption) Option {
+	return func(o *BalancerOptions) {
+		o.connectionOptions = append(o.connectionOptions, opts...)
+	}
+}
+
+// 默认选项
+var defaultOptions = BalancerOptions{
+	client:               http.DefaultClient,
+	initialRetryInterval: 30 * time.Second,
+	maxRetryInterval:     5 * time.Minute,
+}
+
+// Balancer implements a random balancer. Unlike the round-robin balancer,
+// it keeps no state between requests.
+type Balancer struct {
+	conns []balancers.Connection
+
+	mu  sync.Mutex // guards rnd
+	rnd *rand.Rand // nil to use the top-level functions of math/rand
+}
+
+// NewBalancer creates a new random balancer. It can be initializes by
+// a variable number of connections. To use plain URLs instead of
+// connections, use NewBalancerFromURL.
+func NewBalancer(conns ...balancers.Connection) (balancers.Balancer, error) {
+	b := &Balancer{
+		conns: make([]balancers.Connection, 0),
+	}
+	if len(conns) > 0 {
+		b.conns = append(b.conns, conns...)
+	}
+	return b, nil
+}
+
+// NewBalancerFromURL creates a new random balancer from a list of URLs.
+func NewBalancerFromURL(urls []string, opts ...Option) (*Balancer, error) {
+	options := defaultOptions
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// 检查重试间隔配置的合法性
+	if options.initialRetryInterval <= 0 {
+		return nil, errors.New("initial retry interval must be greater than 0")
+	}
+	if options.maxRetryInterval <= 0 {
+		return nil, errors.New("max retry interval must be greater than 0")
+	}
+	if options.maxRetryInterval < options.initialRetryInterval {
+		return nil, errors.New("max retry interval must be greater than or equal to initial retry interval")
+	}
+
+	b := &Balancer{
+		conns: make([]balancers.Connection, 0),
+	}
+	if options.source != nil {
+		b.SetSource(options.source)
+	}
+
+	for _, rawurl := range urls {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		b.conns = append(b.conns, balancers.NewHttpConnection(
+			u,
+			options.client,
+			options.initialRetryInterval,
+			options.maxRetryInterval,
+			options.connectionOptions...,
+		))
+	}
+	return b, nil
+}
+
+// SetSource sets the source of randomness, e.g. to get deterministic
+// results in tests. It is the counterpart of WithSource for balancers
+// created with NewBalancer.
+func (b *Balancer) SetSource(source rand.Source) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rnd = rand.New(source)
+}
+
+// intn returns a random number in [0,n).
+func (b *Balancer) intn(n int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rnd == nil {
+		return rand.Intn(n)
+	}
+	return b.rnd.Intn(n)
+}
+
+// Get returns a random connection that is not broken. Degraded
+// connections are only returned if no healthy connection is left.
+// ErrNoConn is returned when no connection is available.
+func (b *Balancer) Get() (balancers.Connection, error) {
+	if len(b.conns) == 0 {
+		return nil, balancers.ErrNoConn
+	}
+	if conn := b.conns[b.intn(len(b.conns))]; balancers.HealthOf(conn) == balancers.Healthy {
+		return conn, nil
+	}
+
+	// Pick from the healthy connections, or from the degraded ones if
+	// no healthy connection is left.
+	healthy := make([]balancers.Connection, 0, len(b.conns))
+	var degraded []balancers.Connection
+	for _, c := range b.conns {
+		switch balancers.HealthOf(c) {
+		case balancers.Healthy:
+			healthy = append(healthy, c)
+		case balancers.Degraded:
+			degraded = append(degraded, c)
+		}
+	}
+	conns := healthy
+	if len(conns) == 0 {
+		conns = degraded
+	}
+	if len(conns) == 0 {
+		return nil, balancers.ErrNoConn
+	}
+	return conns[b.intn(len(conns))], nil
+}
+
+// Connections returns a list of all connections.
+func (b *Balancer) Connections() []balancers.Connection {
+	conns := make([]balancers.Connection, len(b.conns))
+	copy(conns, b.conns)
+	return conns
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package random
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/internal/balancertest"
+)
+
+func TestBalancerErrNoConnWithoutConnections(t *testing.T) {
+	balancer, err := NewBalancer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = balancer.Get()
+	if err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerPicksEvenly(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	balancer, _ := NewBalancer(a, b)
+
+	counts := make(map[balancers.Connection]int)
+	for i := 0; i < 2000; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[conn]++
+	}
+	if counts[a] < 850 || counts[a] > 1150 {
+		t.Errorf("expected %q to be picked about 1000 times; got: %d", a.URL(), counts[a])
+	}
+}
+
+func TestBalancerSkipsBrokenConnections(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	c := balancertest.NewConn("http://c")
+	a.Broken = true
+	c.Broken = true
+	balancer, _ := NewBalancer(a, b, c)
+
+	for i := 0; i < 20; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != b {
+			t.Fatalf("expected %q; got: %q", b.URL(), conn.URL())
+		}
+	}
+
+	b.Broken = true
+	if _, err := balancer.Get(); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerSetSource(t *testing.T) {
+	conns := []balancers.Connection{balancertest.NewConn("http://a"), balancertest.NewConn("http://b"), balancertest.NewConn("http://c")}
+	run := func() []balancers.Connection {
+		balancer, err := NewBalancer(conns...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		balancer.(*Balancer).SetSource(rand.NewSource(7))
+		var picked []balancers.Connection
+		for i := 0; i < 20; i++ {
+			conn, err := balancer.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			picked = append(picked, conn)
+		}
+		return picked
+	}
+
+	first := run()
+	second := run()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected same sequence with same source; got: %v and %v", first, second)
+		}
+	}
+}
+
+func TestBalancerFromURLWithSource(t *testing.T) {
+	var visited []int
+
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" {
+			visited = append(visited, 1)
+		}
+	}))
+	defer server1.Close()
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" {
+			visited = append(visited, 2)
+		}
+	}))
+	defer server2.Close()
+
+	run := func() []int {
+		visited = nil
+		balancer, err := NewBalancerFromURL(
+			[]string{server1.URL, server2.URL},
+			WithClient(http.DefaultClient),
+			WithInitialRetryInterval(30*time.Second),
+			WithMaxRetryInterval(5*time.Minute),
+			WithSource(rand.NewSource(7)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := balancers.NewClient(balancer)
+		for i := 0; i < 10; i++ {
+			client.Get(server1.URL)
+		}
+		return visited
+	}
+
+	first := run()
+	second := run()
+	if len(first) != 10 || len(second) != 10 {
+		t.Fatalf("expected %d URLs to be visited; got: %d and %d", 10, len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected same sequence with same source; got: %v and %v", first, second)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+// Package rendezvous implements a rendezvous (highest random weight)
+// hashing balancer. For every request, each connection gets a score from
+// hashing the request key together with the connection URL, and the
+// connection with the highest score wins. When a connection is broken,
+// only its keys move, and they spread evenly over the remaining ones.
+package rendezvous
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"net/http"
+
+	"github.com/tianlin/balancers"
+)
+
+// BalancerOptions 包含负载均衡器的配置选项
+type BalancerOptions struct {
+	key balancers.KeyFunc
+}
+
+// Option 定义配置选项的函数类型
+type Option func(*BalancerOptions)
+
+// WithKey sets the function that extracts the key from a request.
+// The default is balancers.PathKey.
+func WithKey(key balancers.KeyFunc) Option {
+	return func(o *BalancerOptions) {
+		o.key = key
+	}
+}
+
+// 默认选项
+var defaultOptions = BalancerOptions{
+	key: balancers.PathKey,
+}
+
+// Balancer implements a rendezvous hashing balancer. Connections
+// implementing balancers.Weighter receive a share of the keys that
+// is proportional to their weight.
+type Balancer struct {
+	conns []balancers.Connection
+	ids   []string // URLs of conns, by index
+	key   balancers.KeyFunc
+}
+
+// NewBalancer creates a new rendezvous hashing balancer. It can be
+// initialized by a variable number of connections. To change the
+// defaults, use NewBalancerWithOptions.
+func NewBalancer(conns ...balancers.Connection) (balancers.Balancer, error) {
+	b, err := NewBalancerWithOptions(conns)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewBalancerWithOptions creates a new rendezvous hashing balancer for
+// the given connections, configured by opts.
+func NewBalancerWithOptions(conns []balancers.Connection, opts ...Option) (*Balancer, error) {
+	options := defaultOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.key == nil {
+		return nil, errors.New("key func must not be nil")
+	}
+
+	b := &Balancer{
+		conns: make([]balancers.Connection, len(conns)),
+		ids:   make([]string, len(conns)),
+		key:   options.key,
+	}
+	copy(b.conns, conns)
+	for i, c := range b.conns {
+		b.ids[i] = c.URL().String()
+	}
+	return b, nil
+}
+
+// Get returns the connection for an empty key.
+// ErrNoConn is returned when no connection is available.
+func (b *Balancer) Get() (balancers.Connection, error) {
+	return b.lookup("", nil)
+}
+
+// GetForRequest returns the non-broken connection with the highest score
+// for the key of r. ErrNoConn is returned when no connection is available.
+func (b *Balancer) GetForRequest(r *http.Request) (balancers.Connection, error) {
+	return b.lookup(b.key(r), nil)
+}
+
+// GetExcluding returns the connection with the highest score for the key
+// of r that is not in exclude. It implements balancers.ExcludingBalancer.
+func (b *Balancer) GetExcluding(r *http.Request, exclude map[balancers.Connection]bool) (balancers.Connection, error) {
+	return b.lookup(b.key(r), exclude)
+}
+
+func (b *Balancer) lookup(key string, exclude map[balancers.Connection]bool) (balancers.Connection, error) {
+	// Healthy connections always win over degraded ones.
+	best := -1
+	bestScore := 0.0
+	var bestHealth balancers.Health
+	for i, c := range b.conns {
+		if exclude[c] {
+			continue
+		}
+		h := balancers.HealthOf(c)
+		if h == balancers.Unhealthy {
+			continue
+		}
+		w := balancers.WeightOf(c)
+		if w <= 0 {
+			continue
+		}
+		s := score(key, b.ids[i], w)
+		// Break ties by URL so the result does not depend on the order
+		// of connections.
+		if best < 0 || h < bestHealth || (h == bestHealth && (s > bestScore || (s == bestScore && b.ids[i] < b.ids[best]))) {
+			best = i
+			bestScore = s
+			bestHealth = h
+		}
+	}
+	if best < 0 {
+		return nil, balancers.ErrNoConn
+	}
+	return b.conns[best], nil
+}
+
+// score returns the weighted score of id for key, i.e. -w/ln(h) with h
+// being a uniformly distributed hash of key and id in the range (0,1).
+func score(key, id string, weight int) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(id))
+	x := mix(h.Sum64())
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(u)
+}
+
+// mix is the finalizer of splitmix64. It improves the distribution of the
+// FNV hash for keys and ids that only differ in their last bytes.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Connections returns a list of all connections.
+func (b *Balancer) Connections() []balancers.Connection {
+	conns := make([]balancers.Connection, len(b.conns))
+	copy(conns, b.conns)
+	return conns
+}
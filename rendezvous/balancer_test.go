@@ -0,0 +1,194 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package rendezvous
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/internal/balancertest"
+)
+
+func newRequest(path string) *http.Request {
+	r, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+	return r
+}
+
+// assign returns the connection for 3000 different paths.
+func assign(t *testing.T, b *Balancer) map[string]balancers.Connection {
+	m := make(map[string]balancers.Connection)
+	for i := 0; i < 3000; i++ {
+		path := fmt.Sprintf("/path/%d", i)
+		conn, err := b.GetForRequest(newRequest(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[path] = conn
+	}
+	return m
+}
+
+func TestBalancerErrNoConnWithoutConnections(t *testing.T) {
+	balancer, err := NewBalancerWithOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = balancer.GetForRequest(newRequest("/"))
+	if err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerIsConsistentAndEven(t *testing.T) {
+	conns := []balancers.Connection{
+		balancertest.NewConn("http://a"),
+		balancertest.NewConn("http://b"),
+		balancertest.NewConn("http://c"),
+	}
+	b1, _ := NewBalancerWithOptions(conns)
+	b2, _ := NewBalancerWithOptions([]balancers.Connection{conns[2], conns[0], conns[1]})
+
+	m1 := assign(t, b1)
+	m2 := assign(t, b2)
+	counts := make(map[balancers.Connection]int)
+	for path, conn := range m1 {
+		if m2[path] != conn {
+			t.Fatalf("expected %q to map to %q; got: %q", path, conn.URL(), m2[path].URL())
+		}
+		counts[conn]++
+	}
+	for _, c := range conns {
+		if counts[c] < 900 || counts[c] > 1100 {
+			t.Errorf("expected %q to receive about 1000 keys; got: %d", c.URL(), counts[c])
+		}
+	}
+}
+
+func TestBalancerRespectsWeights(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	a.Share = 3
+	b := balancertest.NewConn("http://b")
+	balancer, _ := NewBalancerWithOptions([]balancers.Connection{a, b})
+
+	counts := make(map[balancers.Connection]int)
+	for _, conn := range assign(t, balancer) {
+		counts[conn]++
+	}
+	if counts[a] < 2100 || counts[a] > 2400 {
+		t.Errorf("expected %q to receive about 2250 keys; got: %d", a.URL(), counts[a])
+	}
+}
+
+func TestBalancerFallsThroughToNextHighestScore(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	c := balancertest.NewConn("http://c")
+	balancer, _ := NewBalancerWithOptions([]balancers.Connection{a, b, c})
+
+	before := assign(t, balancer)
+	b.Broken = true
+	after := assign(t, balancer)
+	again := assign(t, balancer)
+
+	for path, conn := range before {
+		if conn != b && after[path] != conn {
+			t.Errorf("expected %q to stay on %q; got: %q", path, conn.URL(), after[path].URL())
+		}
+		if after[path] == b {
+			t.Errorf("expected %q to move away from broken connection", path)
+		}
+		if after[path] != again[path] {
+			t.Errorf("expected %q to move deterministically", path)
+		}
+	}
+
+	a.Broken = true
+	c.Broken = true
+	if _, err := balancer.GetForRequest(newRequest("/")); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerWithQueryKey(t *testing.T) {
+	var visited []string
+
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "OPTIONS" {
+				visited = append(visited, name)
+			}
+		}
+	}
+	server1 := httptest.NewServer(handler("server1"))
+	defer server1.Close()
+	server2 := httptest.NewServer(handler("server2"))
+	defer server2.Close()
+
+	url1, _ := url.Parse(server1.URL)
+	url2, _ := url.Parse(server2.URL)
+	conn1 := balancers.NewHttpConnection(url1, http.DefaultClient, 30*time.Second, 5*time.Minute)
+	conn2 := balancers.NewHttpConnection(url2, http.DefaultClient, 30*time.Second, 5*time.Minute)
+	defer conn1.Close()
+	defer conn2.Close()
+	balancer, err := NewBalancerWithOptions(
+		[]balancers.Connection{conn1, conn2},
+		WithKey(balancers.QueryKey("tenant")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := balancers.NewClient(balancer)
+	for i := 0; i < 5; i++ {
+		if _, err := client.Get(fmt.Sprintf("http://example.com/path/%d?tenant=1", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(visited) != 5 {
+		t.Fatalf("expected %d URLs to be visited; got: %d", 5, len(visited))
+	}
+	for i := range visited {
+		if visited[i] != visited[0] {
+			t.Errorf("expected all requests of a tenant to go to %s; got: %v", visited[0], visited)
+			break
+		}
+	}
+}
+
+func TestBalancerGetExcluding(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	c := balancertest.NewConn("http://c")
+	balancer, _ := NewBalancerWithOptions([]balancers.Connection{a, b, c})
+
+	// Excluding a connection picks the one with the next highest score,
+	// i.e. the one that would be picked if it were broken.
+	before := assign(t, balancer)
+	b.Broken = true
+	after := assign(t, balancer)
+	b.Broken = false
+	for path, conn := range before {
+		if conn != b {
+			continue
+		}
+		next, err := balancer.GetExcluding(newRequest(path), map[balancers.Connection]bool{b: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != after[path] {
+			t.Errorf("expected %q to move to %q; got: %q", path, after[path].URL(), next.URL())
+		}
+	}
+
+	exclude := map[balancers.Connection]bool{a: true, b: true, c: true}
+	if _, err := balancer.GetExcluding(newRequest("/"), exclude); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
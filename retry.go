@@ -0,0 +1,160 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy decides whether and when Transport retries a failed
+// request on another connection. See WithRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first
+	// one. Values less than 2 disable retries.
+	MaxAttempts int
+	// Backoff returns the time to wait before the given retry, starting
+	// at 1. If nil, retries are sent immediately.
+	Backoff func(retry int) time.Duration
+	// Retryable reports whether a request that returned res or err is
+	// retried. Exactly one of res and err is not nil. If Retryable is
+	// nil, DefaultRetryable is used.
+	Retryable func(res *http.Response, err error) bool
+}
+
+// WithRetryPolicy makes Transport retry failed requests on connections
+// that have not been tried yet for the same request. Requests with a body
+// are only retried if their GetBody func is set, or if they are buffered;
+// see WithBodyBuffer. Otherwise, the error wraps ErrBodyNotReplayable.
+// Requests that are not idempotent are only retried if the previous
+// attempt failed before it was written; see WithIdempotentMethods.
+func WithRetryPolicy(policy *RetryPolicy) TransportOption {
+	return func(t *Transport) {
+		t.retry = policy
+	}
+}
+
+// DefaultRetryable retries transport errors, except for canceled
+// requests, and responses with status 502 Bad Gateway, 503 Service
+// Unavailable, and 504 Gateway Timeout.
+func DefaultRetryable(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// ExponentialBackoff returns a backoff for RetryPolicy that doubles
+// with every retry, starting at base and limited by max. The actual
+// delay is picked at random from the upper half of that value, so that
+// retries of concurrent requests spread out.
+func ExponentialBackoff(base, max time.Duration) func(retry int) time.Duration {
+	return func(retry int) time.Duration {
+		d := base
+		for i := 1; i < retry && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		if d <= 0 {
+			return 0
+		}
+		return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+}
+
+// mayResend returns true if the Transport may send a request more than
+// once.
+func (t *Transport) mayResend() bool {
+	return t.retryThrottled || t.hedge != nil || (t.retry != nil && t.retry.MaxAttempts > 1)
+}
+
+// shouldRetry returns true if the given retry of a request that returned
+// res or err should be sent.
+func (t *Transport) shouldRetry(res *http.Response, err error, retry int) bool {
+	if t.retry != nil && retry >= t.retry.MaxAttempts {
+		return false
+	}
+	if t.retryThrottled && err == nil {
+		if _, throttled := throttledUntil(res, time.Now()); throttled {
+			return true
+		}
+	}
+	if t.retry == nil {
+		return false
+	}
+	retryable := t.retry.Retryable
+	if retryable == nil {
+		retryable = DefaultRetryable
+	}
+	return retryable(res, err)
+}
+
+// backoff waits before the given retry of r. It returns false if r has
+// been canceled in the meantime.
+func (t *Transport) backoff(r *http.Request, retry int) bool {
+	if t.retry == nil || t.retry.Backoff == nil {
+		return true
+	}
+	d := t.retry.Backoff(retry)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// next returns a connection for r that is not in tried, or nil if the
+// balancer has none.
+func (t *Transport) next(r *http.Request, tried map[Connection]bool) Connection {
+	if eb, ok := t.balancer.(ExcludingBalancer); ok {
+		conn, err := eb.GetExcluding(r, tried)
+		if err != nil || tried[conn] {
+			return nil
+		}
+		return conn
+	}
+
+	conns := t.balancer.Connections()
+	for i := 0; i < len(conns); i++ {
+		conn, err := t.pick(r)
+		if err != nil {
+			return nil
+		}
+		if !tried[conn] {
+			return conn
+		}
+	}
+	// The balancer keeps returning connections that have been tried, e.g.
+	// because it hashes the request: take any other one, healthy first.
+	var degraded Connection
+	for _, conn := range conns {
+		if tried[conn] {
+			continue
+		}
+		switch HealthOf(conn) {
+		case Healthy:
+			return conn
+		case Degraded:
+			if degraded == nil {
+				degraded = conn
+			}
+		}
+	}
+	return degraded
+}
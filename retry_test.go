@@ -0,0 +1,198 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransportRetriesConnectionErrors(t *testing.T) {
+	var requests atomic.Int32
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up := newTestServer(&requests, respondWith(http.StatusOK))
+	defer up.Close()
+
+	balancer := &testRoundRobin{conns: []Connection{newHealthyConn(t, down.URL), newHealthyConn(t, up.URL)}}
+	client := &http.Client{Transport: NewTransport(balancer, WithRetryPolicy(&RetryPolicy{MaxAttempts: 3}))}
+
+	res, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatalf("expected request to be retried; got: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || requests.Load() != 1 {
+		t.Errorf("expected request to succeed on the second host; got: %d after %d requests", res.StatusCode, requests.Load())
+	}
+
+	// Without a retry policy, the error is returned.
+	balancer.idx = 0
+	client = &http.Client{Transport: NewTransport(balancer)}
+	if _, err := client.Get("http://localhost/"); err == nil {
+		t.Error("expected connection error")
+	}
+}
+
+// testHashBalancer always returns the first non-broken connection, like
+// a hash balancer does for a single key.
+type testHashBalancer struct {
+	conns []Connection
+}
+
+func (b *testHashBalancer) Get() (Connection, error) {
+	for _, conn := range b.conns {
+		if !conn.IsBroken() {
+			return conn, nil
+		}
+	}
+	return nil, ErrNoConn
+}
+
+func (b *testHashBalancer) Connections() []Connection { return b.conns }
+
+func TestTransportRetriesOnUntriedConnection(t *testing.T) {
+	var requests atomic.Int32
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up := newTestServer(&requests, respondWith(http.StatusOK))
+	defer up.Close()
+
+	balancer := &testHashBalancer{conns: []Connection{newHealthyConn(t, down.URL), newHealthyConn(t, up.URL)}}
+	client := &http.Client{Transport: NewTransport(balancer, WithRetryPolicy(&RetryPolicy{MaxAttempts: 3}))}
+
+	res, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatalf("expected request to be retried on the other host; got: %v", err)
+	}
+	res.Body.Close()
+	if requests.Load() != 1 {
+		t.Errorf("expected 1 request to the other host; got: %d", requests.Load())
+	}
+}
+
+func TestTransportRetryMaxAttempts(t *testing.T) {
+	var requests atomic.Int32
+	var conns []Connection
+	for i := 0; i < 3; i++ {
+		server := newTestServer(&requests, respondWith(http.StatusBadGateway))
+		defer server.Close()
+		conns = append(conns, newHealthyConn(t, server.URL))
+	}
+
+	var retries []int
+	policy := &RetryPolicy{
+		MaxAttempts: 2,
+		Backoff: func(retry int) time.Duration {
+			retries = append(retries, retry)
+			return time.Millisecond
+		},
+	}
+	client := &http.Client{Transport: NewTransport(&testRoundRobin{conns: conns}, WithRetryPolicy(policy))}
+
+	res, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected last response to be returned; got: %d", res.StatusCode)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("expected %d attempts; got: %d", 2, requests.Load())
+	}
+	if len(retries) != 1 || retries[0] != 1 {
+		t.Errorf("expected backoff before retry 1 only; got: %v", retries)
+	}
+}
+
+func TestTransportRetryClassifier(t *testing.T) {
+	var failed, ok atomic.Int32
+	server1 := newTestServer(&failed, respondWith(http.StatusInternalServerError))
+	defer server1.Close()
+	server2 := newTestServer(&ok, respondWith(http.StatusOK))
+	defer server2.Close()
+	conns := []Connection{newHealthyConn(t, server1.URL), newHealthyConn(t, server2.URL)}
+
+	// 500 is not retryable by default.
+	client := &http.Client{Transport: NewTransport(&testRoundRobin{conns: conns}, WithRetryPolicy(&RetryPolicy{MaxAttempts: 2}))}
+	res, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected no retry; got: %d", res.StatusCode)
+	}
+
+	policy := &RetryPolicy{
+		MaxAttempts: 2,
+		Retryable: func(res *http.Response, err error) bool {
+			return err != nil || res.StatusCode == http.StatusInternalServerError
+		},
+	}
+	client = &http.Client{Transport: NewTransport(&testRoundRobin{conns: conns}, WithRetryPolicy(policy))}
+	res, err = client.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected retry on another host; got: %d", res.StatusCode)
+	}
+}
+
+func TestTransportRetryStopsWhenCanceled(t *testing.T) {
+	var requests atomic.Int32
+	server1 := newTestServer(&requests, respondWith(http.StatusServiceUnavailable))
+	defer server1.Close()
+	server2 := newTestServer(&requests, respondWith(http.StatusOK))
+	defer server2.Close()
+
+	policy := &RetryPolicy{
+		MaxAttempts: 2,
+		Backoff:     func(int) time.Duration { return time.Hour },
+	}
+	balancer := &testRoundRobin{conns: []Connection{newHealthyConn(t, server1.URL), newHealthyConn(t, server2.URL)}}
+	client := &http.Client{Transport: NewTransport(balancer, WithRetryPolicy(policy))}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://localhost/", nil)
+	res, err := client.Do(req)
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected the first response; got: %d", res.StatusCode)
+		}
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected no retry after cancellation; got %d requests", requests.Load())
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(100*time.Millisecond, time.Second)
+	tests := []struct {
+		Retry int
+		Max   time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{10, time.Second},
+	}
+	for _, test := range tests {
+		d := backoff(test.Retry)
+		if d < test.Max/2 || d > test.Max {
+			t.Errorf("retry %d: expected backoff in [%v,%v]; got: %v", test.Retry, test.Max/2, test.Max, d)
+		}
+	}
+}
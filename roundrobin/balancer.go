@@ -19,6 +19,7 @@ type BalancerOptions struct {
 	client               *http.Client
 	initialRetryInterval time.Duration
 	maxRetryInterval     time.Duration
+	connectionOptions    []balancers.ConnectionOption
 }
 
 // Option 定义配置选项的函数类型
@@ -45,6 +46,13 @@ func WithMaxRetryInterval(interval time.Duration) Option {
 	}
 }
 
+// WithConnectionOptions 设置创建 HTTP 连接时使用的选项，例如健康检查
+func WithConnectionOptions(opts ...balancers.ConnectionOption) Option {
+	return func(o *BalancerOptions) {
+		o.connectionOptions = append(o.connectionOptions, opts...)
+	}
+}
+
 // 默认选项
 var defaultOptions = BalancerOptions{
 	client:               http.DefaultClient,
@@ -53,10 +61,16 @@ var defaultOptions = BalancerOptions{
 }
 
 // Balancer implements a round-robin balancer.
+//
+// Connections in slow start, see balancers.SlowStarter, only accumulate
+// their slow-start factor as credit when it is their turn, and are picked
+// once the credit reaches 1. So they get a share of the requests that is
+// proportional to their slow-start factor.
 type Balancer struct {
 	sync.Mutex // guards the following variables
 	conns      []balancers.Connection
-	idx        int // index into conns
+	credits    []float64 // slow-start credit of conns, by index
+	idx        int       // index into conns
 }
 
 // NewBalancer creates a new round-robin balancer. It can be initializes by
@@ -105,13 +119,14 @@ func NewBalancerFromURL(urls []string, opts ...Option) (*Balancer, error) {
 			options.client,
 			options.initialRetryInterval,
 			options.maxRetryInterval,
+			options.connectionOptions...,
 		))
 	}
 	return b, nil
 }
 
 // Get returns a connection from the balancer that can be used for the next request.
-// ErrNoConn is returns when no connection is available.
+// ErrNoConn is returned when no connection is available.
 func (b *Balancer) Get() (balancers.Connection, error) {
 	b.Lock()
 	defer b.Unlock()
@@ -120,20 +135,45 @@ func (b *Balancer) Get() (balancers.Connection, error) {
 		return nil, balancers.ErrNoConn
 	}
 
-	var conn balancers.Connection
+	if len(b.credits) != len(b.conns) {
+		b.credits = make([]float64, len(b.conns))
+	}
+
+	// If all healthy connections lack credit, use the first. Degraded
+	// connections are only used if no healthy connection is left.
+	fallback, degraded := -1, -1
 	for i := 0; i < len(b.conns); i++ {
-		candidate := b.conns[b.idx]
+		idx := b.idx
+		candidate := b.conns[idx]
 		b.idx = (b.idx + 1) % len(b.conns)
-		if !candidate.IsBroken() {
-			conn = candidate
-			break
+		switch balancers.HealthOf(candidate) {
+		case balancers.Unhealthy:
+			continue
+		case balancers.Degraded:
+			if degraded < 0 {
+				degraded = idx
+			}
+			continue
+		}
+		b.credits[idx] += balancers.SlowStartFactorOf(candidate)
+		if b.credits[idx] >= 1 {
+			b.credits[idx]--
+			return candidate, nil
+		}
+		if fallback < 0 {
+			fallback = idx
 		}
 	}
 
-	if conn == nil {
+	if fallback < 0 {
+		fallback = degraded
+	}
+	if fallback < 0 {
 		return nil, balancers.ErrNoConn
 	}
-	return conn, nil
+	// Continue after the fallback so that the next call picks another one.
+	b.idx = (fallback + 1) % len(b.conns)
+	return b.conns[fallback], nil
 }
 
 // Connections returns a list of all connections.
@@ -141,13 +181,6 @@ func (b *Balancer) Connections() []balancers.Connection {
 	b.Lock()
 	defer b.Unlock()
 	conns := make([]balancers.Connection, len(b.conns))
-	for i, c := range b.conns {
-		if oc, ok := c.(*balancers.HttpConnection); ok {
-			// Make a clone
-			cr := new(balancers.HttpConnection)
-			*cr = *oc
-			conns[i] = cr
-		}
-	}
+	copy(conns, b.conns)
 	return conns
 }
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/internal/balancertest"
 )
 
 func TestNewBalancer(t *testing.T) {
@@ -181,3 +182,91 @@ func TestBalancerRewritesSchemeAndURLButNotPathOrQuery(t *testing.T) {
 		t.Errorf("expected 3rd URL to be %q; got: %q", "/no/3", visited[2])
 	}
 }
+
+func TestBalancerWithConnectionOptions(t *testing.T) {
+	var paths []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.URL.Path == "/_health" {
+			paths = append(paths, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	balancer, err := NewBalancerFromURL(
+		[]string{server.URL},
+		WithConnectionOptions(
+			balancers.WithHealthCheckPath("/_health"),
+			balancers.WithHealthCheckMethod("GET"),
+			balancers.WithHealthCheckStatus(balancers.StatusRange{Min: 200, Max: 299}),
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("expected %d health check; got: %d", 1, len(paths))
+	}
+	if _, err := balancer.Get(); err != nil {
+		t.Fatalf("expected connection to be available; got: %v", err)
+	}
+}
+
+func TestBalancerHonorsSlowStart(t *testing.T) {
+	a := balancertest.NewConn("http://127.0.0.1:12345")
+	b := balancertest.NewConn("http://127.0.0.1:23456")
+	b.Factor = 0.5
+
+	balancer, err := NewBalancer(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[balancers.Connection]int)
+	for i := 0; i < 90; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[conn]++
+	}
+	if counts[a] != 60 || counts[b] != 30 {
+		t.Errorf("expected a 2:1 split; got: %d and %d", counts[a], counts[b])
+	}
+
+	// A connection in slow start is used if it is the only one left.
+	balancer, err = NewBalancer(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if conn, err := balancer.Get(); err != nil || conn != b {
+			t.Fatalf("expected %v; got: %v, %v", b.URL(), conn, err)
+		}
+	}
+}
+
+func TestBalancerRotatesDegradedConnections(t *testing.T) {
+	a := balancertest.NewConn("http://127.0.0.1:12345")
+	b := balancertest.NewConn("http://127.0.0.1:23456")
+	c := balancertest.NewConn("http://127.0.0.1:34567")
+	a.State = balancers.Degraded
+	b.State = balancers.Degraded
+	c.Broken = true
+
+	// Degraded connections take turns when no healthy one is left.
+	balancer, err := NewBalancer(a, b, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []balancers.Connection{a, b, a, b}
+	for i, want := range expected {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != want {
+			t.Errorf("expected pick %d to be %v; got: %v", i, want.URL(), conn.URL())
+		}
+	}
+}
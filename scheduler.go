@@ -0,0 +1,355 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// HealthScheduler runs the health checks of many connections from a
+// single goroutine, instead of one heartbeat goroutine per connection.
+// Connections opt in with WithHealthScheduler.
+//
+// Connections to the same URL share a single health check, even if they
+// belong to different balancers, as long as they check it the same way:
+// with the same HealthChecker, or the same settings of the default HTTP
+// check, and the same check timeout, degraded latency, and intervals.
+// Custom checkers that cannot be compared, e.g. a HealthCheckerFunc, are
+// never shared. The shared check runs once, and its result is applied to
+// all of the connections, each with its own rise and fall thresholds.
+// The number of checks that run at the same time is bounded, and the
+// intervals are jittered so that checks do not run in lockstep.
+type HealthScheduler struct {
+	mu      sync.Mutex // guards the following variables
+	targets map[checkKey]*scheduledTarget
+	queue   targetQueue
+	started bool
+
+	sem    chan struct{} // bounds concurrent checks
+	wake   chan struct{} // signals changes of the queue to the loop
+	stop   chan struct{} // closed by Stop, guarded by mu
+	jitter float64
+}
+
+// SchedulerOption configures a HealthScheduler.
+type SchedulerOption func(*HealthScheduler)
+
+// WithConcurrency sets the maximum number of health checks that run at
+// the same time. It is 16 by default.
+func WithConcurrency(n int) SchedulerOption {
+	return func(s *HealthScheduler) {
+		if n > 0 {
+			s.sem = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithJitter randomly shifts each interval by up to the given fraction,
+// e.g. 0.1 runs a check with an interval of 30 seconds after 27 to 33
+// seconds. It is 0.1 by default.
+func WithJitter(fraction float64) SchedulerOption {
+	return func(s *HealthScheduler) {
+		s.jitter = fraction
+	}
+}
+
+// NewHealthScheduler creates a new scheduler. It starts its goroutine
+// when the first connection is added.
+func NewHealthScheduler(opts ...SchedulerOption) *HealthScheduler {
+	s := &HealthScheduler{
+		targets: make(map[checkKey]*scheduledTarget),
+		sem:     make(chan struct{}, 16),
+		wake:    make(chan struct{}, 1),
+		jitter:  0.1,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// DefaultHealthScheduler is a scheduler that can be shared by all
+// balancers of a process. It cannot be stopped.
+var DefaultHealthScheduler = NewHealthScheduler()
+
+// WithHealthScheduler runs the health checks of the connection with the
+// given scheduler instead of a heartbeat goroutine of its own. The
+// initial health check still runs in NewHttpConnection.
+func WithHealthScheduler(s *HealthScheduler) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.scheduler = s
+	}
+}
+
+// Stop stops the goroutine of the scheduler. Health checks of its
+// connections no longer run afterwards, until another connection is
+// added, which restarts the scheduler. Stop does nothing for
+// DefaultHealthScheduler, as it is shared by other balancers.
+func (s *HealthScheduler) Stop() {
+	if s == DefaultHealthScheduler {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		s.started = false
+		close(s.stop)
+	}
+}
+
+// checkKey identifies the health check of a connection. Connections with
+// the same key share their checks.
+type checkKey struct {
+	url     string
+	checker interface{} // custom checker, or the connection if it cannot be compared
+	config  string      // settings of the default checker, timeouts, and intervals
+}
+
+// checkKey returns the key of the health check of c.
+func (c *HttpConnection) checkKey() checkKey {
+	k := checkKey{
+		url: c.url.String(),
+		config: fmt.Sprintf("%v %v %v %v", c.checkTimeout, c.degradedLatency,
+			c.initialRetryInterval, c.maxRetryInterval),
+	}
+	switch {
+	case c.checker == nil:
+		k.config += fmt.Sprintf(" %#v", *c.httpChecker)
+	case reflect.ValueOf(c.checker).Comparable():
+		k.checker = c.checker
+	default:
+		k.checker = c
+	}
+	return k
+}
+
+// scheduledTarget is a health check with all connections that share it.
+type scheduledTarget struct {
+	key   checkKey
+	conns []*HttpConnection // the first one runs the check
+	next  time.Time
+	index int // in queue, or -1 while the check runs
+
+	// The interval between checks grows while the check fails, like the
+	// heartbeat of a connection. interval is only accessed while the
+	// check runs, or while the target is created.
+	interval        time.Duration
+	initialInterval time.Duration
+	maxInterval     time.Duration
+}
+
+// nextInterval returns the time to wait for the next check of t, given
+// the result of the last one.
+func (t *scheduledTarget) nextInterval(err error) time.Duration {
+	if err == nil || errors.Is(err, ErrDegraded) {
+		t.interval = t.initialInterval
+		return t.interval
+	}
+	t.interval *= retryMultiplier
+	if t.interval > t.maxInterval {
+		t.interval = t.maxInterval
+	}
+	return t.interval
+}
+
+// add schedules the health checks of c.
+func (s *HealthScheduler) add(c *HttpConnection) {
+	interval := c.getNextInterval()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := c.checkKey()
+	if t, ok := s.targets[key]; ok {
+		t.conns = append(t.conns, c)
+		s.start()
+		return
+	}
+	t := &scheduledTarget{
+		key:             key,
+		conns:           []*HttpConnection{c},
+		next:            time.Now().Add(s.jittered(interval)),
+		interval:        interval,
+		initialInterval: c.initialRetryInterval,
+		maxInterval:     c.maxRetryInterval,
+	}
+	s.targets[key] = t
+	heap.Push(&s.queue, t)
+	s.signal()
+	s.start()
+}
+
+// start starts the goroutine of the scheduler, unless it is running.
+// s.mu must be held.
+func (s *HealthScheduler) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.stop = make(chan struct{})
+	go s.loop(s.stop)
+}
+
+// remove stops the health checks of c.
+func (s *HealthScheduler) remove(c *HttpConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.targets[c.checkKey()]
+	if !ok {
+		return
+	}
+	for i, conn := range t.conns {
+		if conn == c {
+			t.conns = append(t.conns[:i], t.conns[i+1:]...)
+			break
+		}
+	}
+	if len(t.conns) == 0 {
+		delete(s.targets, t.key)
+		if t.index >= 0 {
+			heap.Remove(&s.queue, t.index)
+		}
+	}
+}
+
+// signal wakes up the loop. s.mu must be held.
+func (s *HealthScheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// jittered returns d shifted randomly by up to s.jitter.
+func (s *HealthScheduler) jittered(d time.Duration) time.Duration {
+	if s.jitter <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*s.jitter*float64(d))
+}
+
+// loop runs the checks that are due, until stop is closed.
+func (s *HealthScheduler) loop(stop chan struct{}) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		select {
+		case <-stop:
+			// Leave the queue to the loop of a restarted scheduler.
+			s.mu.Unlock()
+			return
+		default:
+		}
+		now := time.Now()
+		var due []*scheduledTarget
+		for len(s.queue) > 0 && !s.queue[0].next.After(now) {
+			due = append(due, heap.Pop(&s.queue).(*scheduledTarget))
+		}
+		wait := time.Hour
+		if len(s.queue) > 0 {
+			wait = s.queue[0].next.Sub(now)
+		}
+		s.mu.Unlock()
+
+		for _, t := range due {
+			select {
+			case s.sem <- struct{}{}:
+				go s.run(t)
+			case <-stop:
+				s.requeue(due)
+				return
+			}
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// run checks t and schedules its next check.
+func (s *HealthScheduler) run(t *scheduledTarget) {
+	defer func() { <-s.sem }()
+
+	s.mu.Lock()
+	conns := append([]*HttpConnection(nil), t.conns...)
+	s.mu.Unlock()
+	if len(conns) == 0 {
+		return
+	}
+
+	err := conns[0].check()
+	for _, c := range conns {
+		c.applyCheck(err)
+	}
+	interval := t.nextInterval(err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.push(t, time.Now().Add(s.jittered(interval)))
+}
+
+// requeue puts targets that are due but were not checked because the
+// scheduler was stopped back into the queue.
+func (s *HealthScheduler) requeue(targets []*scheduledTarget) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range targets {
+		s.push(t, t.next)
+	}
+}
+
+// push schedules the next check of t at the given time, unless t has
+// been removed in the meantime. s.mu must be held.
+func (s *HealthScheduler) push(t *scheduledTarget, next time.Time) {
+	if s.targets[t.key] != t || t.index >= 0 {
+		return
+	}
+	t.next = next
+	heap.Push(&s.queue, t)
+	s.signal()
+}
+
+// targetQueue is a min-heap of targets by the time of their next check.
+type targetQueue []*scheduledTarget
+
+func (q targetQueue) Len() int           { return len(q) }
+func (q targetQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q targetQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *targetQueue) Push(x interface{}) {
+	t := x.(*scheduledTarget)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *targetQueue) Pop() interface{} {
+	old := *q
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*q = old[:len(old)-1]
+	return t
+}
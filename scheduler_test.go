@@ -0,0 +1,305 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testChecker is a health checker that can be compared, so that it can
+// be shared by connections.
+type testChecker struct {
+	healthy atomic.Bool
+	calls   atomic.Int64
+}
+
+func (c *testChecker) Check(context.Context, *url.URL) error {
+	c.calls.Add(1)
+	if !c.healthy.Load() {
+		return errors.New("down")
+	}
+	return nil
+}
+
+// targets returns the number of distinct health checks of s.
+func targets(s *HealthScheduler) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.targets)
+}
+
+func TestHealthSchedulerDeduplicatesChecks(t *testing.T) {
+	s := NewHealthScheduler()
+	defer s.Stop()
+
+	checker := new(testChecker)
+	checker.healthy.Store(true)
+
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	conn1 := NewHttpConnection(u, http.DefaultClient, 10*time.Millisecond, 10*time.Millisecond,
+		WithHealthChecker(checker), WithHealthScheduler(s))
+	conn2 := NewHttpConnection(u, http.DefaultClient, 10*time.Millisecond, 10*time.Millisecond,
+		WithHealthChecker(checker), WithHealthScheduler(s))
+	defer conn1.Close()
+	defer conn2.Close()
+	if n := targets(s); n != 1 {
+		t.Fatalf("expected connections to share their health check; got %d checks", n)
+	}
+
+	checker.healthy.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for !conn1.IsBroken() || !conn2.IsBroken() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected both connections to become broken")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthSchedulerSeparatesDifferentChecks(t *testing.T) {
+	shared := new(testChecker)
+	fn := HealthCheckerFunc(func(context.Context, *url.URL) error { return nil })
+	tests := []struct {
+		Name   string
+		Opts1  []ConnectionOption
+		Opts2  []ConnectionOption
+		Shared bool
+	}{
+		{
+			Name:   "DefaultChecker",
+			Shared: true,
+		},
+		{
+			Name:   "SamePath",
+			Opts1:  []ConnectionOption{WithHealthCheckPath("/health")},
+			Opts2:  []ConnectionOption{WithHealthCheckPath("/health")},
+			Shared: true,
+		},
+		{
+			Name:  "DifferentPath",
+			Opts1: []ConnectionOption{WithHealthCheckPath("/health")},
+			Opts2: []ConnectionOption{WithHealthCheckPath("/ready")},
+		},
+		{
+			Name:  "DifferentTimeout",
+			Opts1: []ConnectionOption{WithHealthCheckTimeout(time.Second)},
+			Opts2: []ConnectionOption{WithHealthCheckTimeout(2 * time.Second)},
+		},
+		{
+			Name:  "CustomAndDefaultChecker",
+			Opts1: []ConnectionOption{WithHealthChecker(shared)},
+		},
+		{
+			Name:   "SameCustomChecker",
+			Opts1:  []ConnectionOption{WithHealthChecker(shared)},
+			Opts2:  []ConnectionOption{WithHealthChecker(shared)},
+			Shared: true,
+		},
+		{
+			Name:  "DifferentCustomChecker",
+			Opts1: []ConnectionOption{WithHealthChecker(shared)},
+			Opts2: []ConnectionOption{WithHealthChecker(new(testChecker))},
+		},
+		{
+			Name:  "CheckerFunc",
+			Opts1: []ConnectionOption{WithHealthChecker(fn)},
+			Opts2: []ConnectionOption{WithHealthChecker(fn)},
+		},
+	}
+
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	for _, test := range tests {
+		s := NewHealthScheduler()
+		s.started = true // do not run checks
+		var conns []*HttpConnection
+		for _, opts := range [][]ConnectionOption{test.Opts1, test.Opts2} {
+			conns = append(conns, NewHttpConnection(u, http.DefaultClient, time.Minute, time.Minute,
+				append([]ConnectionOption{WithHealthScheduler(s)}, opts...)...))
+		}
+		want := 2
+		if test.Shared {
+			want = 1
+		}
+		if got := targets(s); got != want {
+			t.Errorf("%s: expected %d health checks; got: %d", test.Name, want, got)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		if got := targets(s); got != 0 {
+			t.Errorf("%s: expected no health checks after close; got: %d", test.Name, got)
+		}
+	}
+}
+
+func TestHealthSchedulerBoundsConcurrency(t *testing.T) {
+	s := NewHealthScheduler(WithConcurrency(1), WithJitter(0))
+	defer s.Stop()
+
+	var running, maxRunning, calls atomic.Int64
+	checker := HealthCheckerFunc(func(context.Context, *url.URL) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		calls.Add(1)
+		for {
+			max := maxRunning.Load()
+			if n <= max || maxRunning.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+
+	for _, rawurl := range []string{"http://127.0.0.1:9200", "http://127.0.0.1:9201", "http://127.0.0.1:9202"} {
+		u, _ := url.Parse(rawurl)
+		conn := NewHttpConnection(u, http.DefaultClient, time.Millisecond, time.Millisecond,
+			WithHealthChecker(checker), WithHealthScheduler(s))
+		defer conn.Close()
+	}
+	// Only count the checks run by the scheduler, not the initial ones.
+	maxRunning.Store(0)
+	calls.Store(0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for calls.Load() < 12 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected scheduler to run health checks")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := maxRunning.Load(); n != 1 {
+		t.Errorf("expected at most 1 concurrent check; got: %d", n)
+	}
+}
+
+func TestHealthSchedulerJitter(t *testing.T) {
+	s := NewHealthScheduler(WithJitter(0.1))
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := s.jittered(time.Second)
+		if d < 900*time.Millisecond || d > 1100*time.Millisecond {
+			t.Fatalf("expected jittered interval within 10%% of 1s; got: %v", d)
+		}
+		distinct[d] = true
+	}
+	if len(distinct) < 2 {
+		t.Error("expected intervals to be jittered")
+	}
+}
+
+func TestHealthSchedulerRemove(t *testing.T) {
+	s := NewHealthScheduler()
+	defer s.Stop()
+
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	healthy := new(testChecker)
+	healthy.healthy.Store(true)
+	conn1 := NewHttpConnection(u, http.DefaultClient, time.Minute, time.Minute,
+		WithHealthChecker(healthy), WithHealthScheduler(s))
+	conn2 := NewHttpConnection(u, http.DefaultClient, time.Minute, time.Minute,
+		WithHealthChecker(healthy), WithHealthScheduler(s))
+
+	conn1.Close()
+	s.mu.Lock()
+	if n := len(s.targets); n != 1 {
+		t.Errorf("expected 1 target; got: %d", n)
+	}
+	s.mu.Unlock()
+
+	conn2.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.targets) != 0 || len(s.queue) != 0 {
+		t.Errorf("expected no targets after all connections are closed; got: %d, %d", len(s.targets), len(s.queue))
+	}
+}
+
+func TestHealthSchedulerRestartsAfterStop(t *testing.T) {
+	s := NewHealthScheduler(WithJitter(0))
+	defer s.Stop()
+
+	checker := new(testChecker)
+	checker.healthy.Store(true)
+	u1, _ := url.Parse("http://127.0.0.1:9200")
+	conn1 := NewHttpConnection(u1, http.DefaultClient, time.Millisecond, time.Millisecond,
+		WithHealthChecker(checker), WithHealthScheduler(s))
+	defer conn1.Close()
+	s.Stop()
+
+	// Adding a connection restarts the scheduler.
+	u2, _ := url.Parse("http://127.0.0.1:9201")
+	conn2 := NewHttpConnection(u2, http.DefaultClient, time.Millisecond, time.Millisecond,
+		WithHealthChecker(checker), WithHealthScheduler(s))
+	defer conn2.Close()
+	calls := checker.calls.Load()
+	deadline := time.Now().Add(5 * time.Second)
+	for checker.calls.Load() < calls+4 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected scheduler to run health checks after restart")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDefaultHealthSchedulerCannotBeStopped(t *testing.T) {
+	DefaultHealthScheduler.Stop()
+
+	checker := new(testChecker)
+	checker.healthy.Store(true)
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	conn := NewHttpConnection(u, http.DefaultClient, time.Millisecond, time.Millisecond,
+		WithHealthChecker(checker), WithHealthScheduler(DefaultHealthScheduler))
+	defer conn.Close()
+
+	DefaultHealthScheduler.Stop()
+	calls := checker.calls.Load()
+	deadline := time.Now().Add(5 * time.Second)
+	for checker.calls.Load() < calls+4 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected default scheduler to keep running health checks")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthSchedulerBacksOffPerTarget(t *testing.T) {
+	s := NewHealthScheduler()
+	s.started = true // do not run checks
+
+	checker := new(testChecker)
+	checker.healthy.Store(true)
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	// The first connection does not become broken after a few failures,
+	// which must not keep the shared check from backing off.
+	conn1 := NewHttpConnection(u, http.DefaultClient, time.Second, 4*time.Second,
+		WithHealthChecker(checker), WithHealthScheduler(s), WithFallThreshold(10))
+	conn2 := NewHttpConnection(u, http.DefaultClient, time.Second, 4*time.Second,
+		WithHealthChecker(checker), WithHealthScheduler(s))
+	defer conn1.Close()
+	defer conn2.Close()
+
+	s.mu.Lock()
+	target := s.targets[conn1.checkKey()]
+	s.mu.Unlock()
+	down := errors.New("down")
+	for i, want := range []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if got := target.nextInterval(down); got != want {
+			t.Errorf("expected interval %v after %d failures; got: %v", want, i+1, got)
+		}
+	}
+	if got := target.nextInterval(ErrDegraded); got != time.Second {
+		t.Errorf("expected interval to be reset when degraded; got: %v", got)
+	}
+	target.nextInterval(down)
+	if got := target.nextInterval(nil); got != time.Second {
+		t.Errorf("expected interval to be reset after success; got: %v", got)
+	}
+}
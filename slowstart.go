@@ -0,0 +1,99 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"math"
+	"time"
+)
+
+// SlowStarter is implemented by connections that ramp up their share of
+// requests after they recovered, e.g. to give a backend time to warm up
+// its caches. Balancers that support slow start, e.g. the ones in the
+// weighted and roundrobin packages, scale the share of a connection by
+// its slow-start factor.
+type SlowStarter interface {
+	// SlowStartFactor returns a value in (0,1] that the share of the
+	// connection is multiplied with. It is 1 when slow start is over.
+	SlowStartFactor() float64
+}
+
+// SlowStartFactorOf returns the slow-start factor of the given connection.
+// Connections that do not implement SlowStarter have a factor of 1.
+func SlowStartFactorOf(c Connection) float64 {
+	if s, ok := c.(SlowStarter); ok {
+		return s.SlowStartFactor()
+	}
+	return 1
+}
+
+// defaultSlowStartFactor is the slow-start factor of a connection that
+// has just recovered if WithSlowStart is given an invalid minFactor.
+const defaultSlowStartFactor = 0.1
+
+// SlowStartAggression returns a curve for WithSlowStartCurve that ramps
+// up the share as progress^(1/aggression). An aggression of 1 is linear;
+// higher values ramp up faster at the beginning of the window. Values
+// that are not greater than 0 are replaced by 1.
+func SlowStartAggression(aggression float64) func(progress float64) float64 {
+	if !(aggression > 0) || math.IsInf(aggression, 1) {
+		aggression = 1
+	}
+	return func(progress float64) float64 {
+		return math.Pow(progress, 1/aggression)
+	}
+}
+
+// WithSlowStart enables slow start: when the connection recovers, i.e.
+// it becomes healthy after it was broken or its ejection is over, its
+// slow-start factor ramps up from minFactor to 1 within window.
+// minFactor must be in (0,1]; otherwise, 0.1 is used. It is disabled by
+// default.
+func WithSlowStart(window time.Duration, minFactor float64) ConnectionOption {
+	return func(c *HttpConnection) {
+		if !(minFactor > 0 && minFactor <= 1) {
+			minFactor = defaultSlowStartFactor
+		}
+		c.slowStart = window
+		c.slowStartMin = minFactor
+	}
+}
+
+// WithSlowStartCurve sets the curve of the slow-start ramp. It maps the
+// progress within the window, from 0 to 1, to a value from 0 to 1. The
+// ramp is linear by default.
+func WithSlowStartCurve(curve func(progress float64) float64) ConnectionOption {
+	return func(c *HttpConnection) {
+		c.slowStartCurve = curve
+	}
+}
+
+// SlowStartFactor returns the slow-start factor of the HTTP connection.
+// It is 1 if slow start is disabled or over. See WithSlowStart.
+func (c *HttpConnection) SlowStartFactor() float64 {
+	if c.slowStart <= 0 {
+		return 1
+	}
+	start := c.recoveredAt.Load()
+	if c.outliers != nil {
+		if until := c.outlierHost.ejectedUntil.Load(); until > start {
+			start = until
+		}
+	}
+	if start == 0 {
+		return 1
+	}
+	elapsed := time.Duration(time.Now().UnixNano() - start)
+	if elapsed >= c.slowStart {
+		return 1
+	}
+	progress := 0.0
+	if elapsed > 0 {
+		progress = float64(elapsed) / float64(c.slowStart)
+	}
+	if c.slowStartCurve != nil {
+		progress = c.slowStartCurve(progress)
+	}
+	return c.slowStartMin + (1-c.slowStartMin)*progress
+}
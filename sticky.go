@@ -0,0 +1,123 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+)
+
+// WithStickyCookie enables sticky sessions. Transport sets a cookie with
+// the given name on responses that identifies the connection that served
+// the request. Requests that carry the cookie are sent to the same
+// connection as long as it is not broken; otherwise, the balancer picks
+// a new connection and the cookie is replaced.
+//
+// The cookie value is an opaque identifier derived from the connection
+// URL, signed with HMAC-SHA256 and the given key, so that clients can
+// neither tell which host served them nor guess the identifier of other
+// hosts. If key is empty, a random key is used; cookies then only work
+// with the Transport that issued them. Pass the same key to all
+// Transports that should accept the cookies of each other.
+//
+// Notice that a http.Client only sends cookies back if it has a Jar.
+func WithStickyCookie(name string, key []byte) TransportOption {
+	return func(t *Transport) {
+		if len(key) == 0 {
+			key = make([]byte, sha256.Size)
+			if _, err := rand.Read(key); err != nil {
+				panic("balancers: cannot generate sticky cookie key: " + err.Error())
+			}
+		}
+		t.sticky = &stickyCookie{
+			name:  name,
+			key:   append([]byte(nil), key...),
+			ids:   make(map[string]string),
+			conns: make(map[string]Connection),
+		}
+	}
+}
+
+// stickyCookie implements cookie-based session affinity.
+type stickyCookie struct {
+	name string
+	key  []byte
+
+	mu      sync.Mutex
+	ids     map[string]string     // connection URL -> cookie value
+	conns   map[string]Connection // cookie value -> connection
+	indexed bool                  // true if conns has all connections of the balancer
+}
+
+// id returns the cookie value for conn.
+func (s *stickyCookie) id(conn Connection) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index(conn)
+}
+
+// index returns the cookie value for conn, and remembers conn as the
+// connection for that value. s.mu must be held.
+func (s *stickyCookie) index(conn Connection) string {
+	u := conn.URL().String()
+	id, found := s.ids[u]
+	if !found {
+		mac := hmac.New(sha256.New, s.key)
+		mac.Write([]byte(u))
+		id = hex.EncodeToString(mac.Sum(nil)[:16])
+		s.ids[u] = id
+	}
+	s.conns[id] = conn
+	return id
+}
+
+// get returns the non-broken connection of b that r has a cookie for,
+// or nil.
+func (s *stickyCookie) get(r *http.Request, b Balancer) Connection {
+	cookie, err := r.Cookie(s.name)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	// The connections of b are indexed once, e.g. for cookies issued
+	// by another Transport with the same key. Connections that are
+	// added later are indexed when they serve their first request.
+	if !s.indexed {
+		for _, conn := range b.Connections() {
+			if conn != nil {
+				s.index(conn)
+			}
+		}
+		s.indexed = true
+	}
+	conn := s.conns[cookie.Value]
+	s.mu.Unlock()
+
+	if conn == nil || conn.IsBroken() {
+		return nil
+	}
+	return conn
+}
+
+// set adds a cookie for conn to res unless r already has it.
+func (s *stickyCookie) set(r *http.Request, res *http.Response, conn Connection) {
+	id := s.id(conn)
+	if cookie, err := r.Cookie(s.name); err == nil && cookie.Value == id {
+		return
+	}
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+	res.Header.Add("Set-Cookie", (&http.Cookie{
+		Name:     s.name,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+	}).String())
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type testConn struct {
+	url    *url.URL
+	broken bool
+}
+
+func (c *testConn) URL() *url.URL  { return c.url }
+func (c *testConn) IsBroken() bool { return c.broken }
+
+// testRoundRobin is a minimal round-robin balancer.
+type testRoundRobin struct {
+	conns []Connection
+	idx   int
+}
+
+func (b *testRoundRobin) Get() (Connection, error) {
+	for i := 0; i < len(b.conns); i++ {
+		conn := b.conns[b.idx]
+		b.idx = (b.idx + 1) % len(b.conns)
+		if !conn.IsBroken() {
+			return conn, nil
+		}
+	}
+	return nil, ErrNoConn
+}
+
+func (b *testRoundRobin) Connections() []Connection { return b.conns }
+
+func TestStickyCookie(t *testing.T) {
+	var visited []int
+
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		visited = append(visited, 1)
+	}))
+	defer server1.Close()
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		visited = append(visited, 2)
+	}))
+	defer server2.Close()
+
+	url1, _ := url.Parse(server1.URL)
+	url2, _ := url.Parse(server2.URL)
+	conn1 := &testConn{url: url1}
+	conn2 := &testConn{url: url2}
+	balancer := &testRoundRobin{conns: []Connection{conn1, conn2}}
+
+	jar, _ := cookiejar.New(nil)
+	client := NewClient(balancer, WithStickyCookie("backend", []byte("secret")))
+	client.Jar = jar
+
+	res, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	setCookie := res.Header.Get("Set-Cookie")
+	if !strings.HasPrefix(setCookie, "backend=") {
+		t.Fatalf("expected sticky cookie; got: %q", setCookie)
+	}
+	if strings.Contains(setCookie, url1.Host) {
+		t.Errorf("expected cookie value to not contain the backend URL; got: %q", setCookie)
+	}
+
+	for i := 0; i < 3; i++ {
+		res, err := client.Get("http://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.Header.Get("Set-Cookie") != "" {
+			t.Errorf("expected no new cookie for a sticky request")
+		}
+	}
+
+	// Fall back to the balancer when the connection is broken.
+	conn1.broken = true
+	res, err = client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("Set-Cookie") == "" {
+		t.Errorf("expected a new cookie after switching connections")
+	}
+	conn1.broken = false
+	res, err = client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	expected := []int{1, 1, 1, 1, 2, 2}
+	if len(visited) != len(expected) {
+		t.Fatalf("expected %d URLs to be visited; got: %d", len(expected), len(visited))
+	}
+	for i := range expected {
+		if visited[i] != expected[i] {
+			t.Errorf("expected request %d to visit server %d; got: %d", i, expected[i], visited[i])
+		}
+	}
+}
+
+func TestStickyCookieIsSigned(t *testing.T) {
+	u, _ := url.Parse("http://server1:9200")
+	conn := &testConn{url: u}
+
+	newCookie := func(key []byte) *stickyCookie {
+		tr := NewTransport(&testRoundRobin{}, WithStickyCookie("backend", key))
+		return tr.sticky
+	}
+	signed1 := newCookie([]byte("key1"))
+	signed2 := newCookie([]byte("key2"))
+	if signed1.id(conn) == signed2.id(conn) {
+		t.Error("expected identifiers signed with different keys to differ")
+	}
+	if id := signed1.id(conn); id != newCookie([]byte("key1")).id(conn) {
+		t.Error("expected identifiers to be stable")
+	}
+
+	// Without a key, a random one is used.
+	random1 := newCookie(nil)
+	random2 := newCookie(nil)
+	if len(random1.key) == 0 {
+		t.Fatal("expected a random key")
+	}
+	if random1.id(conn) == random2.id(conn) {
+		t.Error("expected identifiers signed with random keys to differ")
+	}
+}
+
+// countingBalancer counts the calls to Connections.
+type countingBalancer struct {
+	testRoundRobin
+	calls int
+}
+
+func (b *countingBalancer) Connections() []Connection {
+	b.calls++
+	return b.testRoundRobin.Connections()
+}
+
+func TestStickyCookieIndexesConnectionsOnce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	balancer := &countingBalancer{testRoundRobin: testRoundRobin{conns: []Connection{&testConn{url: u}}}}
+	jar, _ := cookiejar.New(nil)
+	client := NewClient(balancer, WithStickyCookie("backend", []byte("secret")))
+	client.Jar = jar
+
+	for i := 0; i < 5; i++ {
+		res, err := client.Get("http://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if balancer.calls > 1 {
+		t.Errorf("expected connections to be indexed once; got %d calls", balancer.calls)
+	}
+}
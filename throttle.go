@@ -0,0 +1,90 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Throttler is implemented by connections that can be throttled, i.e.
+// that report themselves as broken for a while because the host asked
+// clients to back off. See WithThrottling.
+type Throttler interface {
+	// Throttle throttles the connection until the given time.
+	Throttle(until time.Time)
+}
+
+// WithThrottling makes Transport honor responses with status 429 Too
+// Many Requests or 503 Service Unavailable and a Retry-After header: the
+// connection is throttled until the time given by Retry-After, so that
+// balancers skip it. Connections must implement Throttler.
+//
+// If retry is true, the request is transparently retried on another
+// connection, and the throttled response is only returned if no other
+// connection is available. Requests with a body are only retried if
+// their GetBody func is set, or if they are buffered; see WithBodyBuffer.
+// Requests that are not idempotent are not retried; see
+// WithIdempotentMethods.
+func WithThrottling(retry bool) TransportOption {
+	return func(t *Transport) {
+		t.throttling = true
+		t.retryThrottled = retry
+	}
+}
+
+// maxRetryAfter is the longest time a connection is throttled for,
+// regardless of the Retry-After header.
+const maxRetryAfter = 24 * time.Hour
+
+// throttledUntil returns the time until which res asks clients to back
+// off, and false if res does not.
+func throttledUntil(res *http.Response, now time.Time) (time.Time, bool) {
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+		return time.Time{}, false
+	}
+	return parseRetryAfter(res.Header.Get("Retry-After"), now)
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is
+// either a number of seconds or an HTTP-date. The result is at most
+// maxRetryAfter after now.
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil || errors.Is(err, strconv.ErrRange) {
+		if secs < 0 {
+			return time.Time{}, false
+		}
+		// Clamp before multiplying, so that large values do not overflow.
+		if secs > int64(maxRetryAfter/time.Second) {
+			secs = int64(maxRetryAfter / time.Second)
+		}
+		return now.Add(time.Duration(secs) * time.Second), true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if max := now.Add(maxRetryAfter); t.After(max) {
+		t = max
+	}
+	return t, true
+}
+
+// Throttle throttles the HTTP connection until the given time, i.e. it
+// is reported as broken until then.
+func (c *HttpConnection) Throttle(until time.Time) {
+	c.throttledUntil.Store(until.UnixNano())
+}
+
+// IsThrottled returns true if the HTTP connection is currently throttled.
+func (c *HttpConnection) IsThrottled() bool {
+	return time.Now().UnixNano() < c.throttledUntil.Load()
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package balancers
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	tests := []struct {
+		Value    string
+		Expected time.Time
+		OK       bool
+	}{
+		{"120", now.Add(2 * time.Minute), true},
+		{" 0 ", now, true},
+		{"Wed, 21 Oct 2015 07:30:00 GMT", now.Add(2 * time.Minute), true},
+		{"", time.Time{}, false},
+		{"-1", time.Time{}, false},
+		{"soon", time.Time{}, false},
+		// Large values are clamped instead of overflowing.
+		{"99999999999", now.Add(maxRetryAfter), true},
+		{"99999999999999999999", now.Add(maxRetryAfter), true},
+		{"Fri, 31 Dec 9999 23:59:59 GMT", now.Add(maxRetryAfter), true},
+	}
+	for i, test := range tests {
+		got, ok := parseRetryAfter(test.Value, now)
+		if ok != test.OK || !got.Equal(test.Expected) {
+			t.Errorf("#%d: expected %v, %v; got: %v, %v", i, test.Expected, test.OK, got, ok)
+		}
+	}
+}
+
+// respondWithRetryAfter returns a handler that responds with status and,
+// unless status is 200, a Retry-After header of a minute.
+func respondWithRetryAfter(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.Header().Set("Retry-After", "60")
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, http.StatusText(status))
+	}
+}
+
+func TestTransportThrottlesConnection(t *testing.T) {
+	var throttledRequests, okRequests atomic.Int32
+	throttled := newTestServer(&throttledRequests, respondWithRetryAfter(http.StatusTooManyRequests))
+	defer throttled.Close()
+	ok := newTestServer(&okRequests, respondWithRetryAfter(http.StatusOK))
+	defer ok.Close()
+
+	conn1, conn2 := newHealthyConn(t, throttled.URL), newHealthyConn(t, ok.URL)
+	client := &http.Client{Transport: NewTransport(&testRoundRobin{conns: []Connection{conn1, conn2}}, WithThrottling(false))}
+
+	for i := 0; i < 4; i++ {
+		res, err := client.Get("http://localhost/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if i == 0 && res.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("expected throttled response to be returned; got: %d", res.StatusCode)
+		}
+	}
+	if !conn1.IsThrottled() || !conn1.IsBroken() {
+		t.Error("expected connection to be throttled")
+	}
+	if throttledRequests.Load() != 1 || okRequests.Load() != 3 {
+		t.Errorf("expected 1 request to the throttled host and 3 to the other; got: %d and %d", throttledRequests.Load(), okRequests.Load())
+	}
+}
+
+func TestTransportRetriesThrottledRequests(t *testing.T) {
+	var throttledRequests, okRequests atomic.Int32
+	throttled := newTestServer(&throttledRequests, respondWithRetryAfter(http.StatusServiceUnavailable))
+	defer throttled.Close()
+	ok := newTestServer(&okRequests, respondWithRetryAfter(http.StatusOK))
+	defer ok.Close()
+
+	conn1, conn2 := newHealthyConn(t, throttled.URL), newHealthyConn(t, ok.URL)
+	client := &http.Client{Transport: NewTransport(&testRoundRobin{conns: []Connection{conn1, conn2}}, WithThrottling(true))}
+
+	req, _ := http.NewRequest("PUT", "http://localhost/", strings.NewReader("body"))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected request to be retried on another host; got: %d", res.StatusCode)
+	}
+	if throttledRequests.Load() != 1 || okRequests.Load() != 1 {
+		t.Errorf("expected 1 request to each host; got: %d and %d", throttledRequests.Load(), okRequests.Load())
+	}
+
+	// The throttled response is returned if no other host is left.
+	conn2.Throttle(time.Now().Add(time.Minute))
+	conn1.Throttle(time.Time{})
+	res, err = client.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected throttled response; got: %d", res.StatusCode)
+	}
+}
+
+func TestTransportDoesNotRetryUnreplayableBody(t *testing.T) {
+	var throttledRequests, okRequests atomic.Int32
+	throttled := newTestServer(&throttledRequests, respondWithRetryAfter(http.StatusTooManyRequests))
+	defer throttled.Close()
+	ok := newTestServer(&okRequests, respondWithRetryAfter(http.StatusOK))
+	defer ok.Close()
+
+	conn1, conn2 := newHealthyConn(t, throttled.URL), newHealthyConn(t, ok.URL)
+	client := &http.Client{Transport: NewTransport(&testRoundRobin{conns: []Connection{conn1, conn2}}, WithThrottling(true))}
+
+	// A body without GetBody cannot be sent twice.
+	req, _ := http.NewRequest("PUT", "http://localhost/", io.NopCloser(strings.NewReader("body")))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected throttled response; got: %d", res.StatusCode)
+	}
+	if okRequests.Load() != 0 {
+		t.Errorf("expected no retry; got: %d", okRequests.Load())
+	}
+}
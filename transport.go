@@ -8,48 +8,220 @@
 package balancers
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"sync"
+	"time"
 )
 
 // Transport implements a http Transport for a HTTP load balancer.
 type Transport struct {
 	Base http.RoundTripper
 
-	balancer Balancer
+	balancer       Balancer
+	sticky         *stickyCookie
+	throttling     bool
+	retryThrottled bool
+	retry          *RetryPolicy
+	bodyLimit      int64
+	hedge          *hedger
+	budget         *RetryBudget
+
+	idempotentMethods map[string]bool
+	idempotencyKey    string
 
 	mu     sync.Mutex
 	modReq map[*http.Request]*http.Request
 }
 
+// TransportOption configures a Transport.
+type TransportOption func(*Transport)
+
+// NewTransport returns a Transport that uses b to pick the host for each
+// request.
+func NewTransport(b Balancer, opts ...TransportOption) *Transport {
+	t := &Transport{
+		balancer:          b,
+		idempotentMethods: methodSet(DefaultIdempotentMethods),
+		idempotencyKey:    DefaultIdempotencyKey,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
 // RoundTrip is the core of the balancers package. It accepts a request,
 // replaces host, scheme, and port with the URl provided by the balancer,
 // executes it and returns the response to the caller.
+//
+// Failed requests are retried on other connections, depending on the
+// options of the Transport; see WithRetryPolicy and WithThrottling.
+// Requests that are not idempotent are only retried if they certainly
+// have not reached the host; see WithIdempotentMethods. Slow requests
+// may also be sent to a second connection; see WithHedging.
 func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
-	conn, err := t.balancer.Get()
+	conn, err := t.get(r)
+	if err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, err
+	}
+	body, err := t.body(r)
 	if err != nil {
 		return nil, err
 	}
+	if t.budget != nil {
+		t.budget.deposit()
+	}
+	var wt *writeTrace
+	if t.mayResend() && !t.idempotent(r) {
+		wt = new(writeTrace)
+	}
+	tried := map[Connection]bool{conn: true}
+	res, err := t.send(r, body, body.first, conn, tried, wt)
+
+	for retry := 1; t.shouldRetry(res, err, retry); retry++ {
+		if !t.resendable(r, err, wt) {
+			break
+		}
+		if !body.replayable() {
+			if err != nil {
+				err = fmt.Errorf("%w (not retried: %w)", err, ErrBodyNotReplayable)
+			}
+			break
+		}
+		if t.budget != nil && !t.budget.withdraw() {
+			if err != nil {
+				err = fmt.Errorf("%w (not retried: %w)", err, ErrRetryBudgetExhausted)
+			}
+			break
+		}
+		if !t.backoff(r, retry) {
+			t.refund()
+			break
+		}
+		next := t.next(r, tried)
+		if next == nil {
+			t.refund()
+			break
+		}
+		rb, rerr := body.replay()
+		if rerr != nil {
+			t.refund()
+			if err != nil {
+				err = fmt.Errorf("%w (not retried: %w)", err, rerr)
+			}
+			break
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		tried[next] = true
+		res, err = t.send(r, body, rb, next, tried, wt)
+	}
+	return res, err
+}
 
+// roundTrip sends r with the given body and context to conn. If wt is
+// not nil, it records whether the request has been written.
+func (t *Transport) roundTrip(ctx context.Context, r *http.Request, body io.ReadCloser, conn Connection, wt *writeTrace) (*http.Response, error) {
 	rc := cloneRequest(r)
+	rc.Body = body
+	if wt != nil {
+		wt.reset()
+		ctx = httptrace.WithClientTrace(ctx, wt.clientTrace())
+	}
+	if ctx != r.Context() {
+		rc = rc.WithContext(ctx)
+	}
 	if err := modifyRequest(rc, conn); err != nil {
 		return nil, err
 	}
 	t.setModReq(r, rc)
 
+	tracker, _ := conn.(InflightTracker)
+	if tracker != nil {
+		tracker.RequestStarted()
+	}
+
+	observer, _ := t.balancer.(LatencyObserver)
+	reporter, _ := conn.(OutcomeReporter)
+
+	start := time.Now()
 	res, err := t.base().RoundTrip(rc)
+	// Requests canceled by the caller, or by the Transport itself, e.g.
+	// the copy of a hedged request that lost, say nothing about the
+	// connection. Requests that exceeded their deadline do.
+	canceled := err != nil && errors.Is(ctx.Err(), context.Canceled)
+	if reporter != nil && !canceled {
+		if err != nil {
+			reporter.ReportOutcome(0, err)
+		} else {
+			reporter.ReportOutcome(res.StatusCode, nil)
+		}
+	}
 	if err != nil {
 		t.setModReq(r, nil)
+		if tracker != nil {
+			tracker.RequestFinished()
+		}
 		return nil, err
 	}
+	if observer != nil {
+		observer.ObserveHeaders(conn, time.Since(start))
+	}
+	if t.hedge != nil {
+		t.hedge.observe(time.Since(start))
+	}
+	if t.throttling {
+		if throttler, ok := conn.(Throttler); ok {
+			if until, throttled := throttledUntil(res, time.Now()); throttled {
+				throttler.Throttle(until)
+			}
+		}
+	}
+	if t.sticky != nil {
+		t.sticky.set(r, res, conn)
+	}
 	res.Body = &onEOFReader{
 		rc: res.Body,
-		fn: func() { t.setModReq(rc, nil) },
+		fn: func() {
+			t.setModReq(r, nil)
+			if tracker != nil {
+				tracker.RequestFinished()
+			}
+			if observer != nil {
+				observer.ObserveBody(conn, time.Since(start))
+			}
+		},
 	}
 	return res, nil
 }
 
+// get returns the connection to use for r.
+func (t *Transport) get(r *http.Request) (Connection, error) {
+	if t.sticky != nil {
+		if conn := t.sticky.get(r, t.balancer); conn != nil {
+			return conn, nil
+		}
+	}
+	return t.pick(r)
+}
+
+// pick returns a connection for r from the balancer.
+func (t *Transport) pick(r *http.Request) (Connection, error) {
+	if rb, ok := t.balancer.(RequestBalancer); ok {
+		return rb.GetForRequest(r)
+	}
+	return t.balancer.Get()
+}
+
 // CancelRequest cancels the given request (if canceling is available).
 func (t *Transport) CancelRequest(r *http.Request) {
 	type canceler interface {
@@ -91,6 +263,10 @@ func modifyRequest(r *http.Request, conn Connection) error {
 func cloneRequest(r *http.Request) *http.Request {
 	rc := new(http.Request)
 	*rc = *r
+	if r.URL != nil {
+		u := *r.URL
+		rc.URL = &u
+	}
 	rc.Header = make(http.Header, len(r.Header))
 	for k, s := range r.Header {
 		rc.Header[k] = append([]string(nil), s...)
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestCloseRequest(t *testing.T) {
@@ -93,3 +94,35 @@ func TestModifyRequest(t *testing.T) {
 		}
 	}
 }
+
+type testBalancer struct {
+	conn Connection
+	req  *http.Request
+}
+
+func (b *testBalancer) Get() (Connection, error)  { return nil, ErrNoConn }
+func (b *testBalancer) Connections() []Connection { return []Connection{b.conn} }
+func (b *testBalancer) GetForRequest(r *http.Request) (Connection, error) {
+	b.req = r
+	return b.conn, nil
+}
+
+func TestTransportUsesRequestBalancer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	url, _ := url.Parse(server.URL)
+	balancer := &testBalancer{conn: NewHttpConnection(url, http.DefaultClient, 30*time.Second, 5*time.Minute)}
+
+	req, _ := http.NewRequest("GET", "http://example.com/path", nil)
+	res, err := NewClient(balancer).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if balancer.req == nil || balancer.req.URL.Path != "/path" {
+		t.Errorf("expected GetForRequest to be called with the original request")
+	}
+}
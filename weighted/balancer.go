@@ -0,0 +1,195 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+// Package weighted implements a smooth weighted round-robin balancer,
+// as used e.g. by nginx.
+package weighted
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/tianlin/balancers"
+)
+
+// BalancerOptions 包含负载均衡器的配置选项
+type BalancerOptions struct {
+	client               *http.Client
+	initialRetryInterval time.Duration
+	maxRetryInterval     time.Duration
+	connectionOptions    []balancers.ConnectionOption
+}
+
+// Option 定义配置选项的函数类型
+type Option func(*BalancerOptions)
+
+// WithClient 设置 HTTP 客户端
+func WithClient(client *http.Client) Option {
+	return func(o *BalancerOptions) {
+		o.client = client
+	}
+}
+
+// WithInitialRetryInterval 设置初始重试间隔时间
+func WithInitialRetryInterval(interval time.Duration) Option {
+	return func(o *BalancerOptions) {
+		o.initialRetryInterval = interval
+	}
+}
+
+// WithMaxRetryInterval 设置最大重试间隔时间
+func WithMaxRetryInterval(interval time.Duration) Option {
+	return func(o *BalancerOptions) {
+		o.maxRetryInterval = interval
+	}
+}
+
+// WithConnectionOptions 设置创建 HTTP 连接时使用的选项，例如健康检查
+func WithConnectionOptions(opts ...balancers.ConnectionOption) Option {
+	return func(o *BalancerOptions) {
+		o.connectionOptions = append(o.connectionOptions, opts...)
+	}
+}
+
+// 默认选项
+var defaultOptions = BalancerOptions{
+	client:               http.DefaultClient,
+	initialRetryInterval: 30 * time.Second,
+	maxRetryInterval:     5 * time.Minute,
+}
+
+// Balancer implements a smooth weighted round-robin balancer.
+//
+// The weight of a connection is taken from balancers.WeightOf, scaled by
+// balancers.SlowStartFactorOf while the connection ramps up. On every
+// call to Get, each non-broken connection increases its current weight
+// by its weight, the connection with the highest current weight is picked,
+// and its current weight is decreased by the sum of all weights. This
+// spreads requests evenly instead of sending bursts to heavy connections.
+type Balancer struct {
+	sync.Mutex // guards the following variables
+	conns      []balancers.Connection
+	current    []float64 // current weight of conns, by index
+}
+
+// NewBalancer creates a new weighted round-robin balancer. It can be
+// initialized by a variable number of connections. Use
+// balancers.HttpConnection.SetWeight or implement balancers.Weighter
+// to specify the weight of a connection. To use plain URLs instead of
+// connections, use NewBalancerFromURL.
+func NewBalancer(conns ...balancers.Connection) (balancers.Balancer, error) {
+	b := &Balancer{
+		conns: make([]balancers.Connection, 0),
+	}
+	if len(conns) > 0 {
+		b.conns = append(b.conns, conns...)
+	}
+	b.current = make([]float64, len(b.conns))
+	return b, nil
+}
+
+// NewBalancerFromURL creates a new weighted round-robin balancer from
+// a list of URLs and their weights. Both slices must be of equal length
+// and all weights must be greater than 0.
+func NewBalancerFromURL(urls []string, weights []int, opts ...Option) (*Balancer, error) {
+	options := defaultOptions
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// 检查重试间隔配置的合法性
+	if options.initialRetryInterval <= 0 {
+		return nil, errors.New("initial retry interval must be greater than 0")
+	}
+	if options.maxRetryInterval <= 0 {
+		return nil, errors.New("max retry interval must be greater than 0")
+	}
+	if options.maxRetryInterval < options.initialRetryInterval {
+		return nil, errors.New("max retry interval must be greater than or equal to initial retry interval")
+	}
+
+	if len(urls) != len(weights) {
+		return nil, errors.New("number of weights must match number of urls")
+	}
+	for _, w := range weights {
+		if w <= 0 {
+			return nil, errors.New("weight must be greater than 0")
+		}
+	}
+
+	b := &Balancer{
+		conns: make([]balancers.Connection, 0),
+	}
+
+	for i, rawurl := range urls {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		conn := balancers.NewHttpConnection(
+			u,
+			options.client,
+			options.initialRetryInterval,
+			options.maxRetryInterval,
+			options.connectionOptions...,
+		)
+		conn.SetWeight(weights[i])
+		b.conns = append(b.conns, conn)
+	}
+	b.current = make([]float64, len(b.conns))
+	return b, nil
+}
+
+// Get returns a connection from the balancer that can be used for the next request.
+// ErrNoConn is returned when no connection is available.
+func (b *Balancer) Get() (balancers.Connection, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	// Degraded connections are only used if no healthy one is left.
+	health := make([]balancers.Health, len(b.conns))
+	use := balancers.Degraded
+	for i, conn := range b.conns {
+		health[i] = balancers.HealthOf(conn)
+		if health[i] == balancers.Healthy {
+			use = balancers.Healthy
+		}
+	}
+
+	best := -1
+	total := 0.0
+	for i, conn := range b.conns {
+		if health[i] != use {
+			continue
+		}
+		w := float64(balancers.WeightOf(conn)) * balancers.SlowStartFactorOf(conn)
+		if w <= 0 {
+			continue
+		}
+		b.current[i] += w
+		total += w
+		if best < 0 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return nil, balancers.ErrNoConn
+	}
+	b.current[best] -= total
+	return b.conns[best], nil
+}
+
+// Connections returns a list of all connections.
+func (b *Balancer) Connections() []balancers.Connection {
+	b.Lock()
+	defer b.Unlock()
+	conns := make([]balancers.Connection, len(b.conns))
+	copy(conns, b.conns)
+	return conns
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package weighted
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/internal/balancertest"
+)
+
+func TestBalancerErrNoConnWithoutConnections(t *testing.T) {
+	balancer, err := NewBalancer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = balancer.Get()
+	if err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerSmoothWeightedRoundRobin(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	a.Share = 5
+	b := balancertest.NewConn("http://b")
+	c := balancertest.NewConn("http://c")
+
+	balancer, err := NewBalancer(a, b, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a", "a", "b", "a", "c", "a", "a", "a", "a", "b", "a", "c", "a", "a"}
+	for i, host := range expected {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.URL().Host != host {
+			t.Errorf("expected pick %d to be %q; got: %q", i, host, conn.URL().Host)
+		}
+	}
+}
+
+func TestBalancerSkipsBrokenConnections(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	a.Share = 3
+	b := balancertest.NewConn("http://b")
+	a.Broken = true
+
+	balancer, err := NewBalancer(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != b {
+			t.Errorf("expected %q; got: %q", b.URL(), conn.URL())
+		}
+	}
+
+	b.Broken = true
+	_, err = balancer.Get()
+	if err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestNewBalancerFromURLValidatesWeights(t *testing.T) {
+	_, err := NewBalancerFromURL([]string{"http://127.0.0.1:12345"}, []int{1, 2})
+	if err == nil {
+		t.Error("expected error when weights do not match urls")
+	}
+	_, err = NewBalancerFromURL([]string{"http://127.0.0.1:12345"}, []int{0})
+	if err == nil {
+		t.Error("expected error when weight is 0")
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	var visited []int
+
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" {
+			visited = append(visited, 1)
+		}
+	}))
+	defer server1.Close()
+
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" {
+			visited = append(visited, 2)
+		}
+	}))
+	defer server2.Close()
+
+	balancer, err := NewBalancerFromURL(
+		[]string{server1.URL, server2.URL},
+		[]int{2, 1},
+		WithClient(http.DefaultClient),
+		WithInitialRetryInterval(30*time.Second),
+		WithMaxRetryInterval(5*time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := balancers.NewClient(balancer)
+	for i := 0; i < 6; i++ {
+		client.Get(server1.URL)
+	}
+
+	expected := []int{1, 2, 1, 1, 2, 1}
+	if len(visited) != len(expected) {
+		t.Fatalf("expected %d URLs to be visited; got: %d", len(expected), len(visited))
+	}
+	for i := range expected {
+		if visited[i] != expected[i] {
+			t.Errorf("expected request %d to visit server %d; got: %d", i, expected[i], visited[i])
+		}
+	}
+}
+
+func TestBalancerHonorsSlowStart(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	b := balancertest.NewConn("http://b")
+	b.Factor = 0.25
+
+	balancer, err := NewBalancer(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[conn.URL().Host]++
+	}
+	if counts["a"] != 80 || counts["b"] != 20 {
+		t.Errorf("expected a 4:1 split; got: %v", counts)
+	}
+
+	b.Factor = 1
+	counts = make(map[string]int)
+	for i := 0; i < 100; i++ {
+		conn, _ := balancer.Get()
+		counts[conn.URL().Host]++
+	}
+	if counts["a"] != 50 || counts["b"] != 50 {
+		t.Errorf("expected an even split after slow start; got: %v", counts)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+
+// Package weightedrandom implements a balancer that picks a connection at
+// random, with a probability proportional to its weight. It uses the alias
+// method, so picking a connection takes constant time.
+package weightedrandom
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/tianlin/balancers"
+)
+
+// BalancerOptions 包含负载均衡器的配置选项
+type BalancerOptions struct {
+	client               *http.Client
+	initialRetryInterval time.Duration
+	maxRetryInterval     time.Duration
+	connectionOptions    []balancers.ConnectionOption
+	source               rand.Source
+}
+
+// Option 定义配置选项的函数类型
+type Option func(*BalancerOptions)
+
+// WithClient 设置 HTTP 客户端
+func WithClient(client *http.Client) Option {
+	return func(o *BalancerOptions) {
+		o.client = client
+	}
+}
+
+// WithInitialRetryInterval 设置初始重试间隔时间
+func WithInitialRetryInterval(interval time.Duration) Option {
+	return func(o *BalancerOptions) {
+		o.initialRetryInterval = interval
+	}
+}
+
+// WithMaxRetryInterval 设置最大重试间隔时间
+func WithMaxRetryInterval(interval time.Duration) Option {
+	return func(o *BalancerOptions) {
+		o.maxRetryInterval = interval
+	}
+}
+
+// WithSource 设置随机数来源，例如在测试中获得确定的结果，默认使用 math/rand 的顶层函数
+func WithSource(source rand.Source) Option {
+	return func(o *BalancerOptions) {
+		o.source = source
+	}
+}
+
+// WithConnectionOptions 设置创建 HTTP 连接时使用的选项，例如健康检查
+func WithConnectionOptions(opts ...balancers.ConnectionOption) Option {
+	return func(o *BalancerOptions) {
+		o.connectionOptions = append(o.connectionOptions, opts...)
+	}
+}
+
+// 默认选项
+var defaultOptions = BalancerOptions{
+	client:               http.DefaultClient,
+	initialRetryInterval: 30 * time.Second,
+	maxRetryInterval:     5 * time.Minute,
+}
+
+// Balancer implements a weighted random balancer.
+//
+// The weights are taken from balancers.WeightOf when the balancer is
+// created. Connections with a weight of 0 or less are never picked.
+type Balancer struct {
+	conns   []balancers.Connection
+	weights []int
+	prob    []float64 // alias table: probability to keep column i
+	alias   []int     // alias table: alternative for column i
+
+	mu  sync.Mutex // guards rnd
+	rnd *rand.Rand // nil to use the top-level functions of math/rand
+}
+
+// NewBalancer creates a new weighted random balancer. It can be
+// initialized by a variable number of connections. Use
+// balancers.HttpConnection.SetWeight or implement balancers.Weighter
+// to specify the weight of a connection. To use plain URLs instead of
+// connections, use NewBalancerFromURL.
+func NewBalancer(conns ...balancers.Connection) (balancers.Balancer, error) {
+	b := &Balancer{
+		conns: make([]balancers.Connection, 0),
+	}
+	if len(conns) > 0 {
+		b.conns = append(b.conns, conns...)
+	}
+	b.build()
+	return b, nil
+}
+
+// NewBalancerFromURL creates a new weighted random balancer from a list
+// of URLs and their weights. Both slices must be of equal length and all
+// weights must be greater than 0.
+func NewBalancerFromURL(urls []string, weights []int, opts ...Option) (*Balancer, error) {
+	options := defaultOptions
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// 检查重试间隔配置的合法性
+	if options.initialRetryInterval <= 0 {
+		return nil, errors.New("initial retry interval must be greater than 0")
+	}
+	if options.maxRetryInterval <= 0 {
+		return nil, errors.New("max retry interval must be greater than 0")
+	}
+	if options.maxRetryInterval < options.initialRetryInterval {
+		return nil, errors.New("max retry interval must be greater than or equal to initial retry interval")
+	}
+
+	if len(urls) != len(weights) {
+		return nil, errors.New("number of weights must match number of urls")
+	}
+	for _, w := range weights {
+		if w <= 0 {
+			return nil, errors.New("weight must be greater than 0")
+		}
+	}
+
+	b := &Balancer{
+		conns: make([]balancers.Connection, 0),
+	}
+	if options.source != nil {
+		b.SetSource(options.source)
+	}
+
+	for i, rawurl := range urls {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		conn := balancers.NewHttpConnection(
+			u,
+			options.client,
+			options.initialRetryInterval,
+			options.maxRetryInterval,
+			options.connectionOptions...,
+		)
+		conn.SetWeight(weights[i])
+		b.conns = append(b.conns, conn)
+	}
+	b.build()
+	return b, nil
+}
+
+// build creates the alias table with Vose's algorithm.
+func (b *Balancer) build() {
+	n := len(b.conns)
+	b.weights = make([]int, n)
+	b.prob = make([]float64, n)
+	b.alias = make([]int, n)
+
+	total := 0
+	for i, c := range b.conns {
+		if w := balancers.WeightOf(c); w > 0 {
+			b.weights[i] = w
+			total += w
+		}
+	}
+	if total == 0 {
+		return
+	}
+
+	// Scale weights so that the average is 1.
+	scaled := make([]float64, n)
+	var small, large []int
+	for i, w := range b.weights {
+		scaled[i] = float64(w) * float64(n) / float64(total)
+		if scaled[i] < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+	for len(small) > 0 && len(large) > 0 {
+		s, l := small[len(small)-1], large[len(large)-1]
+		small = small[:len(small)-1]
+		b.prob[s] = scaled[s]
+		b.alias[s] = l
+		scaled[l] = scaled[l] + scaled[s] - 1
+		if scaled[l] < 1 {
+			large = large[:len(large)-1]
+			small = append(small, l)
+		}
+	}
+	// Remaining columns are full, up to rounding errors.
+	for _, i := range large {
+		b.prob[i] = 1
+	}
+	for _, i := range small {
+		b.prob[i] = 1
+	}
+}
+
+// SetSource sets the source of randomness, e.g. to get deterministic
+// results in tests. It is the counterpart of WithSource for balancers
+// created with NewBalancer.
+func (b *Balancer) SetSource(source rand.Source) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rnd = rand.New(source)
+}
+
+// intn returns a random number in [0,n).
+func (b *Balancer) intn(n int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rnd == nil {
+		return rand.Intn(n)
+	}
+	return b.rnd.Intn(n)
+}
+
+// float64 returns a random number in [0.0,1.0).
+func (b *Balancer) float64() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rnd == nil {
+		return rand.Float64()
+	}
+	return b.rnd.Float64()
+}
+
+// Get returns a random connection that is not broken. Degraded
+// connections are only returned if no healthy connection is left.
+// ErrNoConn is returned when no connection is available.
+func (b *Balancer) Get() (balancers.Connection, error) {
+	n := len(b.conns)
+	if n == 0 {
+		return nil, balancers.ErrNoConn
+	}
+
+	i := b.intn(n)
+	if b.float64() >= b.prob[i] {
+		i = b.alias[i]
+	}
+	if conn := b.conns[i]; b.weights[i] > 0 && balancers.HealthOf(conn) == balancers.Healthy {
+		return conn, nil
+	}
+
+	// Pick from the healthy connections, or from the degraded ones if
+	// no healthy connection is left.
+	var healthy, degraded []int
+	healthyTotal, degradedTotal := 0, 0
+	for i, c := range b.conns {
+		if b.weights[i] <= 0 {
+			continue
+		}
+		switch balancers.HealthOf(c) {
+		case balancers.Healthy:
+			healthy = append(healthy, i)
+			healthyTotal += b.weights[i]
+		case balancers.Degraded:
+			degraded = append(degraded, i)
+			degradedTotal += b.weights[i]
+		}
+	}
+	candidates, total := healthy, healthyTotal
+	if total == 0 {
+		candidates, total = degraded, degradedTotal
+	}
+	if total == 0 {
+		return nil, balancers.ErrNoConn
+	}
+	r := b.intn(total)
+	for _, i := range candidates {
+		if r < b.weights[i] {
+			return b.conns[i], nil
+		}
+		r -= b.weights[i]
+	}
+	return nil, balancers.ErrNoConn
+}
+
+// Connections returns a list of all connections.
+func (b *Balancer) Connections() []balancers.Connection {
+	conns := make([]balancers.Connection, len(b.conns))
+	copy(conns, b.conns)
+	return conns
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2014-2015 Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// See LICENSE file for details.
+package weightedrandom
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tianlin/balancers"
+	"github.com/tianlin/balancers/internal/balancertest"
+)
+
+func TestBalancerErrNoConnWithoutConnections(t *testing.T) {
+	balancer, err := NewBalancer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = balancer.Get()
+	if err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestBalancerRespectsWeights(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	a.Share = 6
+	b := balancertest.NewConn("http://b")
+	b.Share = 3
+	c := balancertest.NewConn("http://c")
+	d := balancertest.NewConn("http://d")
+	d.Share = 0
+	balancer, _ := NewBalancer(a, b, c, d)
+	balancer.(*Balancer).SetSource(rand.NewSource(1))
+
+	counts := make(map[balancers.Connection]int)
+	for i := 0; i < 10000; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[conn]++
+	}
+	expected := map[*balancertest.Conn]int{a: 6000, b: 3000, c: 1000, d: 0}
+	for conn, want := range expected {
+		if got := counts[conn]; got < want*9/10 || got > want*11/10 {
+			t.Errorf("expected %q to be picked about %d times; got: %d", conn.URL(), want, got)
+		}
+	}
+}
+
+func TestBalancerSkipsBrokenConnections(t *testing.T) {
+	a := balancertest.NewConn("http://a")
+	a.Share = 10
+	b := balancertest.NewConn("http://b")
+	a.Broken = true
+	balancer, _ := NewBalancer(a, b)
+
+	for i := 0; i < 20; i++ {
+		conn, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn != b {
+			t.Fatalf("expected %q; got: %q", b.URL(), conn.URL())
+		}
+	}
+
+	b.Broken = true
+	if _, err := balancer.Get(); err != balancers.ErrNoConn {
+		t.Fatalf("expected %v; got: %v", balancers.ErrNoConn, err)
+	}
+}
+
+func TestNewBalancerFromURLValidatesWeights(t *testing.T) {
+	_, err := NewBalancerFromURL([]string{"http://127.0.0.1:12345"}, []int{1, 2})
+	if err == nil {
+		t.Error("expected error when weights do not match urls")
+	}
+	_, err = NewBalancerFromURL([]string{"http://127.0.0.1:12345"}, []int{-1})
+	if err == nil {
+		t.Error("expected error when weight is negative")
+	}
+}
+
+func TestBalancerFromURL(t *testing.T) {
+	var visited []int
+
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" {
+			visited = append(visited, 1)
+		}
+	}))
+	defer server1.Close()
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" {
+			visited = append(visited, 2)
+		}
+	}))
+	defer server2.Close()
+
+	balancer, err := NewBalancerFromURL(
+		[]string{server1.URL, server2.URL},
+		[]int{9, 1},
+		WithClient(http.DefaultClient),
+		WithInitialRetryInterval(30*time.Second),
+		WithMaxRetryInterval(5*time.Minute),
+		WithSource(rand.NewSource(1)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := balancers.NewClient(balancer)
+	for i := 0; i < 100; i++ {
+		client.Get(server1.URL)
+	}
+
+	if len(visited) != 100 {
+		t.Fatalf("expected %d URLs to be visited; got: %d", 100, len(visited))
+	}
+	n := 0
+	for _, v := range visited {
+		if v == 1 {
+			n++
+		}
+	}
+	if n < 80 {
+		t.Errorf("expected server 1 to receive about 90 requests; got: %d", n)
+	}
+}